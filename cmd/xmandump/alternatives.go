@@ -0,0 +1,40 @@
+package main
+
+import (
+	"archive/tar"
+	"sort"
+	"strings"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+)
+
+// alternativeManpages returns symlink headers for the manpage links registered by pkg's
+// alternatives groups, as XBPS would create them when the package provides the group. Entries take
+// the form "link:target", where target may be relative to the link's directory or absolute.
+func alternativeManpages(pkg *xrepo.Package) []*tar.Header {
+	groups := make([]string, 0, len(pkg.Alternatives))
+	for group := range pkg.Alternatives {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var hdrs []*tar.Header
+	for _, group := range groups {
+		for _, alt := range pkg.Alternatives[group] {
+			sep := strings.IndexByte(alt, ':')
+			if sep == -1 {
+				continue
+			}
+			link, target := alt[:sep], alt[sep+1:]
+			if !strings.HasPrefix(link, manDirsPrefix) || target == "" {
+				continue
+			}
+			hdrs = append(hdrs, &tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "." + link,
+				Linkname: target,
+			})
+		}
+	}
+	return hdrs
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// hiddenFlagPrefix is the prefix of flags omitted from usage and completion. These are for testing
+// only.
+const hiddenFlagPrefix = "chaos-"
+
+var errChaosPackage = errors.New("chaos: injected package failure")
+
+// chaos injects failures for testing. All methods may be called on a nil *chaos, in which case no
+// failures are injected.
+type chaos struct {
+	FailRate    float64
+	SlowRead    time.Duration
+	ENOSPCAfter int64
+
+	written int64 // atomic
+
+	m   sync.Mutex
+	rnd *rand.Rand
+}
+
+// newChaos returns a chaos using the given seed, or nil if no failures are configured.
+func newChaos(failRate float64, slowRead time.Duration, enospcAfter, seed int64) *chaos {
+	if failRate <= 0 && slowRead <= 0 && enospcAfter <= 0 {
+		return nil
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &chaos{
+		FailRate:    failRate,
+		SlowRead:    slowRead,
+		ENOSPCAfter: enospcAfter,
+		rnd:         rand.New(rand.NewSource(seed)),
+	}
+}
+
+// failPackage returns an error if a package failure should be injected.
+func (c *chaos) failPackage() error {
+	if c == nil || c.FailRate <= 0 {
+		return nil
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.rnd.Float64() < c.FailRate {
+		return errChaosPackage
+	}
+	return nil
+}
+
+// reader returns r wrapped such that every read is delayed by SlowRead.
+func (c *chaos) reader(r io.Reader) io.Reader {
+	if c == nil || c.SlowRead <= 0 {
+		return r
+	}
+	return &slowReader{r: r, delay: c.SlowRead}
+}
+
+// writer returns w wrapped such that writes fail with ENOSPC once ENOSPCAfter bytes have been
+// written across all writers.
+func (c *chaos) writer(w io.Writer) io.Writer {
+	if c == nil || c.ENOSPCAfter <= 0 {
+		return w
+	}
+	return &enospcWriter{w: w, c: c}
+}
+
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+type enospcWriter struct {
+	w io.Writer
+	c *chaos
+}
+
+func (e *enospcWriter) Write(p []byte) (int, error) {
+	if atomic.AddInt64(&e.c.written, int64(len(p))) > e.c.ENOSPCAfter {
+		return 0, &os.PathError{Op: "write", Path: "chaos", Err: syscall.ENOSPC}
+	}
+	return e.w.Write(p)
+}
+
+// isHiddenFlag returns whether a flag is omitted from usage and completion.
+func isHiddenFlag(name string) bool {
+	return strings.HasPrefix(name, hiddenFlagPrefix)
+}
+
+// usage prints usage for all flags in flag.CommandLine that are not hidden.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(out, "  %s [flags] repodata...\n", os.Args[0])
+	for _, name := range subcommandNames() {
+		fmt.Fprintf(out, "  %s %s\n", os.Args[0], subcommands[name].Usage)
+	}
+
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !isHiddenFlag(f.Name) {
+			visible.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	visible.PrintDefaults()
+}
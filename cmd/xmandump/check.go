@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+func init() {
+	subcommands["check"] = &subcommand{
+		Usage: "check [-j N] [-a] [-skip-suffixes list] [-unknown-format policy] repodata... -- verify packages' manpages without writing anything",
+		Run:   runCheck,
+	}
+}
+
+// packageReport describes the manpages of a single package, as reported by the check subcommand.
+type packageReport struct {
+	Package  string   `json:"package"`
+	File     string   `json:"file"`
+	Format   string   `json:"format,omitempty"`
+	Claimed  []string `json:"claimed,omitempty"`
+	Missing  []string `json:"missing,omitempty"`  // Listed in files.plist but not in the archive
+	Unlisted []string `json:"unlisted,omitempty"` // In the archive but not listed in files.plist
+	Error    string   `json:"error,omitempty"`
+}
+
+// OK returns whether the package has no errors or discrepancies.
+func (r *packageReport) OK() bool {
+	return r.Error == "" && len(r.Missing) == 0 && len(r.Unlisted) == 0
+}
+
+func runCheck(args []string) int {
+	var (
+		flagLevel           = zap.WarnLevel
+		jobs          int64 = 4
+		all           bool
+		skipSuffixes  = defaultSkipSuffixes
+		unknownFormat = unknownFormatFail
+	)
+
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Var(&flagLevel, "v", "log level")
+	fs.Int64Var(&jobs, "j", jobs, "number of packages to check concurrently")
+	fs.BoolVar(&all, "a", false, "report all packages with manpages, not only those with problems")
+	fs.StringVar(&skipSuffixes, "skip-suffixes", skipSuffixes, "comma-separated package name suffixes to ignore, as when dumping")
+	fs.StringVar(&unknownFormat, "unknown-format", unknownFormat, "how to treat packages with an unsupported compression format, as when dumping: fail or skip")
+	_ = fs.Parse(args)
+
+	if jobs < 1 {
+		return fatalf("invalid -j: must be >= 1")
+	} else if unknownFormat != unknownFormatFail && unknownFormat != unknownFormatSkip {
+		return fatalf("invalid -unknown-format: must be fail or skip")
+	}
+
+	// Packages are skipped the same way they are when dumping.
+	d := &Dumper{
+		SkipSuffixes: splitList(skipSuffixes),
+		SkipUnknown:  unknownFormat == unknownFormatSkip,
+	}
+
+	logger, err := NewLogger(zap.NewAtomicLevelAt(flagLevel))
+	if err != nil {
+		return fatalf("unable to create logger: %v", err)
+	}
+	ctx := WithLogger(context.Background(), logger)
+
+	var (
+		m      sync.Mutex
+		enc    = json.NewEncoder(os.Stdout)
+		failed int
+	)
+	report := func(r packageReport) {
+		m.Lock()
+		defer m.Unlock()
+		if !r.OK() {
+			failed++
+		} else if !all || len(r.Claimed) == 0 {
+			return
+		}
+		_ = enc.Encode(r)
+	}
+
+	sema := semaphore.NewWeighted(jobs)
+	wg, ctx := errgroup.WithContext(ctx)
+	for _, file := range fs.Args() {
+		rd, err := d.readRepoData(ctx, file)
+		if err != nil {
+			return fatalf("unable to read repodata %s: %v", file, err)
+		}
+
+		dir := filepath.Dir(file)
+		for _, pkg := range rd.Index() {
+			pkg := pkg
+			if suffix := matchSuffix(d.SkipSuffixes, pkg.Name); suffix != "" {
+				Debug(ctx, "Ignored package by suffix", logFile(pkg.PackageVersion), zap.String("suffix", suffix))
+				continue
+			}
+			pkgfile := filepath.Join(dir, pkg.PackageVersion+"."+pkg.Architecture+".xbps")
+			if err := sema.Acquire(ctx, 1); err != nil {
+				break
+			}
+			wg.Go(func() error {
+				defer sema.Release(1)
+				if r, ok := d.checkPackage(ctx, pkg, pkgfile); ok {
+					report(r)
+				}
+				return nil
+			})
+		}
+	}
+	_ = wg.Wait()
+
+	if failed > 0 {
+		logger.Warn("Packages with problems found", zap.Int("packages", failed))
+		return 1
+	}
+	return 0
+}
+
+// checkPackage reads the package at file and compares the manpages listed in its files.plist with
+// the manpages in the archive. Entries are matched as they are when dumping, so that only manpages
+// a run would find missing or unlisted are reported. It returns false if the package would be
+// skipped by a run.
+func (d *Dumper) checkPackage(ctx context.Context, pkg *xrepo.Package, file string) (report packageReport, ok bool) {
+	ctx = WithFields(ctx, logFile(file))
+	report = packageReport{Package: pkg.PackageVersion, File: file}
+	fail := func(msg string, err error) (packageReport, bool) {
+		Error(ctx, msg, zap.Error(err))
+		report.Error = err.Error()
+		return report, true
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return fail("Cannot open file", err)
+	}
+	defer f.Close()
+
+	report.Format, err = detectFormat(file)
+	if _, unsupported := err.(*unsupportedFormatError); unsupported && d.SkipUnknown {
+		Warn(ctx, "Skipping package with unsupported compression format", zap.Error(err))
+		return report, false
+	} else if err != nil {
+		return fail("Unable to detect compression format", err)
+	}
+
+	dec, err := newDecompressor(report.Format, f)
+	if err != nil {
+		return fail("Unable to create decompressor", err)
+	}
+	defer dec.Close()
+
+	var (
+		tf       = tar.NewReader(dec)
+		files    packageFiles
+		found    = map[string]struct{}{} // Manpages in the archive
+		entries  = map[string]struct{}{} // All entries in the archive, which a run counts as found
+		hasFiles bool
+	)
+	for {
+		hdr, err := tf.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail("Error encountered reading package", err)
+		}
+
+		if isArchiveMetadata(hdr) {
+			continue
+		}
+
+		entries[manpageKey(hdr.Name)] = struct{}{}
+		name := path.Clean(hdr.Name)
+		if name == "files.plist" && hdr.Typeflag == tar.TypeReg {
+			if err := decodeFilesList(tf, defaultPlistMemLimit, &files); err != nil {
+				return fail("Error reading files list", err)
+			}
+			hasFiles = true
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+		default:
+			continue
+		}
+		if strings.HasPrefix(name, manPathPrefix) && checkPackagePath(hdr.Name) == nil {
+			found[manpageKey(name)] = struct{}{}
+		}
+	}
+
+	if !hasFiles {
+		Warn(ctx, "Package has no files list")
+	}
+
+	claimed := files.manpages()
+	for name := range claimed {
+		report.Claimed = append(report.Claimed, name)
+		if _, ok := entries[name]; !ok {
+			report.Missing = append(report.Missing, name)
+		}
+	}
+	for name := range found {
+		if _, ok := claimed[name]; !ok {
+			report.Unlisted = append(report.Unlisted, name)
+		}
+	}
+	sort.Strings(report.Claimed)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Unlisted)
+
+	if !report.OK() {
+		Warn(ctx, "Package manpages do not match files list",
+			zap.Strings("missing", report.Missing),
+			zap.Strings("unlisted", report.Unlisted))
+	}
+	return report, true
+}
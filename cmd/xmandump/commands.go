@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// subcommand is a command run in place of the default dump when its name is the first argument to
+// xmandump.
+type subcommand struct {
+	Usage string
+	Run   func(args []string) int
+}
+
+// subcommands holds all subcommands by name. It is populated in init functions to allow
+// subcommands to refer to it.
+var subcommands = map[string]*subcommand{}
+
+// runSubcommand runs the subcommand named by the first of args, if there is one, and exits.
+// Otherwise, it returns and the default dump runs.
+func runSubcommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return
+	}
+	os.Exit(cmd.Run(args[1:]))
+}
+
+// subcommandNames returns the sorted names of all subcommands.
+func subcommandNames() []string {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fatalf prints an error message to standard error and returns exit status 1. It is for use in
+// subcommands that do not create a logger.
+func fatalf(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "Fatal error: "+format+"\n", args...)
+	return 1
+}
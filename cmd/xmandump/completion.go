@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+func init() {
+	subcommands["completion"] = &subcommand{
+		Usage: "completion bash|zsh|fish | completion repodata cache -- print a shell completion script, or the repodata files recorded in a cache for one",
+		Run:   runCompletion,
+	}
+}
+
+// Completion scripts complete repodata arguments as file names and, if a cache file is given with
+// -c, as the repodata files recorded in it. Manpage section names aren't completed, since no flag or
+// argument takes one.
+
+// flagCompletions holds the possible values of flags that accept a fixed set of values. Flags not
+// listed here that take a value complete as file names.
+var flagCompletions = map[string][]string{
+	"v":              {"debug", "info", "warn", "error", "dpanic", "panic", "fatal"},
+	"sign-tool":      {signToolSignify, signToolMinisign},
+	"unknown-format": {unknownFormatFail, unknownFormatSkip},
+	"repo-layout":    {repoLayoutMerge, repoLayoutSplit},
+	"whatis":         {whatisMakewhatis, whatisMandb},
+	"search-engine":  {searchEngineMeilisearch, searchEngineElasticsearch},
+	"color":          {colorAuto, colorAlways, colorNever},
+	"log-format":     {logFormatFull, logFormatCompact},
+	"log-output":     {logOutputStderr, logOutputJournald, logOutputSyslog},
+}
+
+// completionFlag describes a flag for use in completion scripts.
+type completionFlag struct {
+	Name   string
+	Usage  string
+	Bool   bool
+	Values []string
+}
+
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		if isHiddenFlag(f.Name) {
+			return
+		}
+		bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{
+			Name:   f.Name,
+			Usage:  f.Usage,
+			Bool:   ok && bf.IsBoolFlag(),
+			Values: flagCompletions[f.Name],
+		})
+	})
+	return flags
+}
+
+func runCompletion(args []string) int {
+	if len(args) == 2 && args[0] == "repodata" {
+		files, err := cachedRepoData(args[1])
+		if err != nil {
+			return fatalf("unable to read cache: %v", err)
+		}
+		for _, file := range files {
+			fmt.Println(file)
+		}
+		return 0
+	} else if len(args) != 1 {
+		return fatalf("usage: %s %s", os.Args[0], subcommands["completion"].Usage)
+	}
+
+	flags := completionFlags(flag.CommandLine)
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, flags)
+	case "zsh":
+		writeZshCompletion(os.Stdout, flags)
+	case "fish":
+		writeFishCompletion(os.Stdout, flags)
+	default:
+		return fatalf("unsupported shell: %s", args[0])
+	}
+	return 0
+}
+
+// cachedRepoData returns the sorted repodata files recorded in the cache file by the last run that
+// processed all of them.
+func cachedRepoData(cacheFile string) ([]string, error) {
+	p, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	var cache cacheRecords
+	if err := json.Unmarshal(p, &cache); err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(cache.Repodata))
+	for file := range cache.Repodata {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// shellQuote quotes s in single quotes for use in a POSIX-like shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func writeBashCompletion(w io.Writer, flags []completionFlag) {
+	var names, fileFlags []string
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+		if !f.Bool && len(f.Values) == 0 {
+			fileFlags = append(fileFlags, "-"+f.Name)
+		}
+	}
+
+	fmt.Fprintln(w, "_xmandump_cached_repodata() {")
+	fmt.Fprintln(w, "\tlocal i")
+	fmt.Fprintln(w, "\tfor ((i = 1; i < COMP_CWORD - 1; i++)); do")
+	fmt.Fprintln(w, "\t\tcase \"${COMP_WORDS[i]}\" in")
+	fmt.Fprintln(w, "\t\t-c|--c)")
+	fmt.Fprintln(w, "\t\t\txmandump completion repodata \"${COMP_WORDS[i+1]}\" 2>/dev/null")
+	fmt.Fprintln(w, "\t\t\treturn;;")
+	fmt.Fprintln(w, "\t\tesac")
+	fmt.Fprintln(w, "\tdone")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_xmandump() {")
+	fmt.Fprintln(w, "\tlocal cur prev")
+	fmt.Fprintln(w, "\tcur=\"${COMP_WORDS[COMP_CWORD]}\"")
+	fmt.Fprintln(w, "\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"")
+	fmt.Fprintln(w, "\tif [ \"$COMP_CWORD\" -eq 2 ] && [ \"$prev\" = completion ]; then")
+	fmt.Fprintln(w, "\t\tCOMPREPLY=($(compgen -W 'bash zsh fish' -- \"$cur\"))")
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase \"$prev\" in")
+	for _, f := range flags {
+		if len(f.Values) > 0 {
+			fmt.Fprintf(w, "\t-%s|--%s)\n", f.Name, f.Name)
+			fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(strings.Join(f.Values, " ")))
+			fmt.Fprintln(w, "\t\treturn;;")
+		}
+	}
+	if len(fileFlags) > 0 {
+		fmt.Fprintf(w, "\t%s)\n", strings.Join(fileFlags, "|"))
+		fmt.Fprintln(w, "\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))")
+		fmt.Fprintln(w, "\t\treturn;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "\tif [[ \"$cur\" == -* ]]; then")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(strings.Join(names, " ")))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(strings.Join(subcommandNames(), " ")))
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tCOMPREPLY+=($(compgen -f -X '!*-repodata' -- \"$cur\") $(compgen -d -- \"$cur\"))")
+	fmt.Fprintln(w, "\tCOMPREPLY+=($(compgen -W \"$(_xmandump_cached_repodata)\" -- \"$cur\"))")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _xmandump xmandump")
+}
+
+// zshEscape escapes characters with special meaning in _arguments specs.
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, `:`, `\:`, `'`, `'\''`).Replace(s)
+}
+
+func writeZshCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "#compdef xmandump")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_xmandump_cached_repodata() {")
+	fmt.Fprintln(w, "\t[[ -n ${opt_args[-c]} ]] || return 1")
+	fmt.Fprintln(w, "\tlocal -a files")
+	fmt.Fprintln(w, "\tfiles=(${(f)\"$(xmandump completion repodata ${(Q)opt_args[-c]} 2>/dev/null)\"})")
+	fmt.Fprintln(w, "\tcompadd -a files")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_xmandump() {")
+	fmt.Fprintln(w, "\tif (( CURRENT == 3 )) && [[ $words[2] == completion ]]; then")
+	fmt.Fprintln(w, "\t\t_values shell bash zsh fish")
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\t_arguments \\")
+	for _, f := range flags {
+		spec := "-" + f.Name + "[" + zshEscape(f.Usage) + "]"
+		switch {
+		case f.Bool:
+		case len(f.Values) > 0:
+			spec += ":value:(" + strings.Join(f.Values, " ") + ")"
+		default:
+			spec += ":file:_files"
+		}
+		fmt.Fprintf(w, "\t\t'%s' \\\n", spec)
+	}
+	fmt.Fprintf(w, "\t\t'1: :_alternative \"commands:command:(%s)\" \"files:repodata:_files -g \\\"*-repodata\\\"\" \"cached:cached repodata:_xmandump_cached_repodata\"' \\\n", strings.Join(subcommandNames(), " "))
+	fmt.Fprintln(w, "\t\t'*: :_alternative \"files:repodata:_files -g \\\"*-repodata\\\"\" \"cached:cached repodata:_xmandump_cached_repodata\"'")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_xmandump \"$@\"")
+}
+
+func writeFishCompletion(w io.Writer, flags []completionFlag) {
+	commands := strings.Join(subcommandNames(), " ")
+	fmt.Fprintln(w, "function __fish_xmandump_cached_repodata")
+	fmt.Fprintln(w, "\tset -l tokens (commandline -opc)")
+	fmt.Fprintln(w, "\tset -l i (contains -i -- -c $tokens); or return")
+	fmt.Fprintln(w, "\ttest $i -lt (count $tokens); and xmandump completion repodata $tokens[(math $i + 1)] 2>/dev/null")
+	fmt.Fprintln(w, "end")
+	fmt.Fprintf(w, "complete -c xmandump -n '__fish_use_subcommand' -a %s\n", shellQuote(commands))
+	fmt.Fprintln(w, "complete -c xmandump -n 'not __fish_seen_subcommand_from completion' -a '(__fish_xmandump_cached_repodata)'")
+	fmt.Fprintln(w, "complete -c xmandump -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'")
+	for _, f := range flags {
+		line := "complete -c xmandump -o " + f.Name + " -d " + shellQuote(f.Usage)
+		switch {
+		case f.Bool:
+		case len(f.Values) > 0:
+			line += " -x -a " + shellQuote(strings.Join(f.Values, " "))
+		default:
+			line += " -r -F"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// config is the configuration file format. It holds a set of named profiles, each bundling a set
+// of flags and repodata arguments.
+type config struct {
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// profile is a named set of flags and arguments. Flags given on the command line take precedence
+// over flags in the profile, and arguments in the profile are only used if none are given on the
+// command line.
+type profile struct {
+	Flags map[string]flagValues `json:"flags"`
+	Args  []string              `json:"args"`
+}
+
+// flagValues holds one or more values for a flag. In JSON, it may be a single string, number, or
+// boolean, or an array of these for flags that may be repeated.
+type flagValues []string
+
+func (f *flagValues) UnmarshalJSON(p []byte) error {
+	var values []interface{}
+	if err := json.Unmarshal(p, &values); err != nil {
+		var value interface{}
+		if err := json.Unmarshal(p, &value); err != nil {
+			return err
+		}
+		values = []interface{}{value}
+	}
+
+	*f = (*f)[:0]
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			*f = append(*f, v)
+		case float64, bool:
+			*f = append(*f, fmt.Sprint(v))
+		default:
+			return fmt.Errorf("invalid flag value: %s", p)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads a configuration file.
+func loadConfig(file string) (*config, error) {
+	p, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var conf config
+	if err := json.Unmarshal(p, &conf); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// applyProfile sets all flags in the named profile that were not set on the command line and returns
+// the arguments to use. If args is non-empty, it is returned as-is.
+func (c *config) applyProfile(fs *flag.FlagSet, profName string, args []string) ([]string, error) {
+	prof, ok := c.Profiles[profName]
+	if !ok || prof == nil {
+		return nil, fmt.Errorf("profile not found: %s", profName)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := make([]string, 0, len(prof.Flags))
+	for name := range prof.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if set[name] {
+			continue
+		}
+		if name == "config" || name == "profile" {
+			return nil, fmt.Errorf("profile %s: flag -%s may not be set in a profile", profName, name)
+		}
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("profile %s: unknown flag -%s", profName, name)
+		}
+		for _, value := range prof.Flags[name] {
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("profile %s: invalid value %q for flag -%s: %v", profName, value, name, err)
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		args = prof.Args
+	}
+	return args, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+)
+
+// pageConflict is a path in the output tree provided by more than one package.
+type pageConflict struct {
+	Path     string   `json:"path"`
+	Packages []string `json:"packages"`
+}
+
+// conflicts returns the paths in the output tree that are provided by packages with different
+// names, sorted by path. Different versions or architectures of the same package are not
+// conflicts. Which package's copy ends up in the tree is undefined.
+func (d *Dumper) conflicts() []pageConflict {
+	var conflicts []pageConflict
+	for p, shas := range d.pathProviders() {
+		if len(shas) < 2 {
+			continue
+		}
+
+		names := map[string]struct{}{}
+		pkgvers := map[string]struct{}{}
+		for _, sha := range shas {
+			d.m.Lock()
+			pkg := d.packages[sha]
+			d.m.Unlock()
+			if pkg != nil {
+				names[pkg.Name] = struct{}{}
+			} else {
+				names[sha] = struct{}{}
+			}
+			pkgvers[d.packageName(sha)] = struct{}{}
+		}
+		if len(names) < 2 {
+			continue
+		}
+		conflicts = append(conflicts, pageConflict{Path: p, Packages: sortedKeys(pkgvers)})
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+	return conflicts
+}
+
+// writeConflicts writes conflicts to file as a JSON array.
+func writeConflicts(file string, conflicts []pageConflict) error {
+	if conflicts == nil {
+		conflicts = []pageConflict{}
+	}
+	p, err := json.Marshal(conflicts)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, p, 0644)
+}
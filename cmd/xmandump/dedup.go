@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// dedupTempSuffix is the suffix of the temporary link used to replace a file with a link to the
+// dedup store.
+const dedupTempSuffix = ".xmandump-dedup"
+
+// dedupFile replaces the file at relpath with a hard link to the file with the same content and
+// attributes in the content-addressed store at dir, adding it to the store if it isn't there yet.
+// The file's mode, owner, and modification time must already be set, since they're shared by every
+// link to it. The store must be on the same filesystem as the output tree.
+func dedupFile(ctx context.Context, dir, relpath string) error {
+	f, err := os.Open(relpath)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		logClose(ctx, f)
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	logClose(ctx, f)
+	if err != nil {
+		return err
+	}
+	// Files are only linked to stored files with the same attributes, so that linking them doesn't
+	// change anything but their inode.
+	uid, gid := fileIDs(fi)
+	fmt.Fprintf(h, "\x00%o %d %d %d", fi.Mode().Perm(), uid, gid, fi.ModTime().UnixNano())
+	sum := hex.EncodeToString(h.Sum(nil))
+	stored := filepath.Join(dir, sum[:2], sum)
+
+	if err := os.MkdirAll(filepath.Dir(stored), 0777); err != nil {
+		return err
+	}
+	err = os.Link(relpath, stored)
+	if err == nil {
+		Debug(ctx, "Added file to dedup store", zap.String("stored", stored))
+		return nil
+	} else if !os.IsExist(err) {
+		return err
+	}
+
+	// Identical content is already stored -- replace the file with a link to it.
+	tmp := relpath + dedupTempSuffix
+	if err := removeExisting(tmp); err != nil {
+		return err
+	}
+	if err := os.Link(stored, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, relpath); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	Debug(ctx, "Linked file to dedup store", zap.String("stored", stored))
+	return nil
+}
+
+// sweepDedupStore removes files from the store at dir that are no longer linked from anywhere
+// else. It returns the number of files removed.
+func sweepDedupStore(dir string) (removed int, err error) {
+	buckets, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, bucket := range buckets {
+		if !bucket.IsDir() {
+			continue
+		}
+		bucketDir := filepath.Join(dir, bucket.Name())
+		files, err := ioutil.ReadDir(bucketDir)
+		if err != nil {
+			return removed, err
+		}
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() || linkCount(fi) > 1 {
+				continue
+			}
+			if err := os.Remove(filepath.Join(bucketDir, fi.Name())); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"sort"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+
+	"go.uber.org/zap"
+)
+
+func init() {
+	subcommands["diff"] = &subcommand{
+		Usage: "diff [-c cache] old-repodata new-repodata -- report packages added, removed, and updated between two repodata files",
+		Run:   runDiff,
+	}
+}
+
+// repoDiff describes the changes between two repodata files, as reported by the diff subcommand.
+type repoDiff struct {
+	Added   []string         `json:"added"`   // pkgvers of new packages
+	Removed []string         `json:"removed"` // pkgvers of packages no longer present
+	Updated []updatedPackage `json:"updated"`
+
+	// Churn is the expected change in manpages, if a cache was given.
+	Churn *pageChurn `json:"churn,omitempty"`
+}
+
+// updatedPackage is a package whose file changed between two repodata files.
+type updatedPackage struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// pageChurn estimates the manpages a run over the new repodata would change, using the manpages
+// recorded in the cache for the old packages.
+type pageChurn struct {
+	Removed   int `json:"removed"`   // Manpages of removed packages
+	Rewritten int `json:"rewritten"` // Manpages of the old versions of updated packages
+	// Unknown is the number of added and updated packages whose manpages cannot be estimated,
+	// since the cache does not record them.
+	Unknown int `json:"unknown"`
+}
+
+func runDiff(args []string) int {
+	var (
+		flagLevel = zap.WarnLevel
+		cacheFile string
+	)
+
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Var(&flagLevel, "v", "log level")
+	fs.StringVar(&cacheFile, "c", "", "cache file used to estimate manpage churn")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return fatalf("usage: %s %s", os.Args[0], subcommands["diff"].Usage)
+	}
+
+	logger, err := NewLogger(zap.NewAtomicLevelAt(flagLevel))
+	if err != nil {
+		return fatalf("unable to create logger: %v", err)
+	}
+	ctx := WithLogger(context.Background(), logger)
+
+	var cache *cacheRecords
+	if cacheFile != "" {
+		records, err := readCacheFile(cacheFile)
+		if err != nil {
+			return fatalf("unable to read cache: %v", err)
+		}
+		cache = &records
+	}
+
+	var indexes [2]map[string]*xrepo.Package
+	for i, file := range fs.Args() {
+		rd, err := (&Dumper{}).readRepoData(ctx, file)
+		if err != nil {
+			return fatalf("unable to read repodata %s: %v", file, err)
+		}
+		indexes[i] = map[string]*xrepo.Package{}
+		for _, pkg := range rd.Index() {
+			indexes[i][pkg.Name] = pkg
+		}
+	}
+
+	diff := diffRepoData(indexes[0], indexes[1], cache)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(diff); err != nil {
+		return fatalf("unable to write diff: %v", err)
+	}
+	return 0
+}
+
+// diffRepoData compares the packages of two repodata files, keyed by name. If cache is not nil, it
+// is used to estimate the manpage churn.
+func diffRepoData(oldIndex, newIndex map[string]*xrepo.Package, cache *cacheRecords) *repoDiff {
+	diff := &repoDiff{Added: []string{}, Removed: []string{}, Updated: []updatedPackage{}}
+	if cache != nil {
+		diff.Churn = &pageChurn{}
+	}
+	// Packages are cached by their file's hash, qualified by repository in the split layout.
+	cachedPages := func(pkg *xrepo.Package) (int, bool) {
+		if cache == nil {
+			return 0, false
+		}
+		for _, key := range []string{pkg.FilenameSHA256, pkg.Repository + "/" + pkg.FilenameSHA256} {
+			if paths, ok := cache.Cache[key]; ok {
+				return len(paths), true
+			}
+		}
+		return 0, false
+	}
+
+	for name, pkg := range newIndex {
+		prev, ok := oldIndex[name]
+		if !ok {
+			diff.Added = append(diff.Added, pkg.PackageVersion)
+			if diff.Churn != nil {
+				diff.Churn.Unknown++
+			}
+			continue
+		} else if prev.FilenameSHA256 == pkg.FilenameSHA256 {
+			continue
+		}
+		diff.Updated = append(diff.Updated, updatedPackage{Name: name, Old: prev.PackageVersion, New: pkg.PackageVersion})
+		if n, ok := cachedPages(prev); ok {
+			diff.Churn.Rewritten += n
+		} else if diff.Churn != nil {
+			diff.Churn.Unknown++
+		}
+	}
+	for name, pkg := range oldIndex {
+		if _, ok := newIndex[name]; ok {
+			continue
+		}
+		diff.Removed = append(diff.Removed, pkg.PackageVersion)
+		if n, ok := cachedPages(pkg); ok {
+			diff.Churn.Removed += n
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Updated, func(i, j int) bool { return diff.Updated[i].Name < diff.Updated[j].Name })
+	return diff
+}
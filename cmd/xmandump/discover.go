@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// repoDataSuffix is the suffix of repodata file names (e.g., x86_64-repodata).
+const repoDataSuffix = "-repodata"
+
+// findRepoData expands directories in args, such as the root of a mirror, to the repodata files
+// found beneath them, in lexical order. Other arguments are returned as-is. Repodata files found are
+// selected by filter, whose patterns are matched against their paths relative to the directory
+// (e.g., current/nonfree/x86_64-repodata) or, for patterns without a slash, their names.
+func findRepoData(args []string, filter *packageFilter) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil || !fi.IsDir() {
+			// Leave errors to be reported when the file is read.
+			files = append(files, arg)
+			continue
+		}
+
+		var found int
+		err = filepath.Walk(arg, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() || !strings.HasSuffix(fi.Name(), repoDataSuffix) {
+				return nil
+			}
+			rel, err := filepath.Rel(arg, p)
+			if err != nil {
+				return err
+			}
+			if filter.matchPath(filepath.ToSlash(rel)) {
+				files = append(files, p)
+				found++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if found == 0 {
+			return nil, fmt.Errorf("no repodata files found in %s", arg)
+		}
+	}
+	return files, nil
+}
+
+// matchPath returns whether the slash-separated path is selected by the filter. Patterns without
+// a slash are matched against the path's last element. A nil filter selects every path.
+func (f *packageFilter) matchPath(p string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Include) > 0 && !matchAnyPath(f.Include, p) {
+		return false
+	}
+	return !matchAnyPath(f.Exclude, p)
+}
+
+func matchAnyPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		name := p
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandGlobs expands arguments containing glob patterns (see filepath.Match) to the files they
+// match, in lexical order, so that patterns work the same regardless of the calling shell. Arguments
+// naming existing files are never expanded.
+func expandGlobs(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, `*?[\`) {
+			files = append(files, arg)
+			continue
+		}
+		if _, err := os.Lstat(arg); err == nil {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", arg)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// repoDataHashes returns the SHA-256 hash of each repodata file, keyed by its absolute path.
+func repoDataHashes(files []string) (map[string]string, error) {
+	hashes := make(map[string]string, len(files))
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		p, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		hashes[abs] = sha256Hex(p)
+	}
+	return hashes, nil
+}
+
+// sameRepoData returns whether two sets of repodata hashes are equal. An empty set is never equal to
+// another, so that runs without recorded hashes are never skipped.
+func sameRepoData(a, b map[string]string) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+	for file, sum := range a {
+		if b[file] != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// runOnlyFlags are flags that don't affect the output tree or cache, and so don't change the options
+// fingerprint. Flags that only re-extract cached packages are included, since their output is the
+// same as a normal run's.
+var runOnlyFlags = map[string]bool{
+	"v": true, "color": true, "no-color": true, "log-format": true, "log-output": true,
+	"log-sample": true, "log-sample-thereafter": true,
+	"cpuprofile": true, "memprofile": true, "blockprofile": true, "mutexprofile": true, "trace": true,
+	"slowest": true, "status-addr": true, "tui": true, "events": true, "config": true, "profile": true,
+	"c": true, "L": true, "j": true, "R": true, "zstd-concurrency": true, "mmap": true,
+	"max-memory": true, "write-rate": true, "min-free": true, "k": true, "max-errors": true,
+	"sandbox": true, "user": true, "group": true,
+	"force": true, "force-package": true, "repair": true, "plan": true,
+}
+
+// optionsFingerprint returns a hash of the flags set in fs that affect the output of a run, so that
+// a run with different options isn't skipped as unchanged.
+func optionsFingerprint(fs *flag.FlagSet) string {
+	var b strings.Builder
+	fs.Visit(func(f *flag.Flag) {
+		if !runOnlyFlags[f.Name] {
+			fmt.Fprintf(&b, "%s=%q\n", f.Name, f.Value.String())
+		}
+	})
+	return sha256Hex([]byte(b.String()))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types written to an event stream.
+const (
+	eventPackageStarted  = "package-started"
+	eventPackageFinished = "package-finished"
+	eventPageWritten     = "page-written"
+	eventError           = "error"
+	eventRemoved         = "removed"
+	eventPagesMissing    = "pages-missing"
+)
+
+// event is a single event in an event stream. Events are written as newline-delimited JSON.
+type event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Repodata string    `json:"repodata,omitempty"`
+	Package  string    `json:"package,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Paths    []string  `json:"paths,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// withEventType returns a copy of ev with the given type.
+func withEventType(ev event, typ string) event {
+	ev.Type = typ
+	return ev
+}
+
+// eventWriter writes events to a stream. It is safe for concurrent use, and all methods may be
+// called on a nil *eventWriter, in which case they do nothing.
+type eventWriter struct {
+	m   sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// openEventWriter opens an event stream. If dest is an integer, it is used as an already-open file
+// descriptor. Otherwise, dest is a file that is created or truncated.
+func openEventWriter(dest string) (*eventWriter, error) {
+	var w io.WriteCloser
+	if fd, err := strconv.ParseUint(dest, 10, 0); err == nil {
+		w = os.NewFile(uintptr(fd), "events")
+	} else if f, err := os.Create(dest); err != nil {
+		return nil, err
+	} else {
+		w = f
+	}
+	return &eventWriter{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// emit writes ev to the stream. If ev has no time set, the current time is used.
+func (e *eventWriter) emit(ev event) {
+	if e == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	_ = e.enc.Encode(ev)
+}
+
+// Close closes the stream.
+func (e *eventWriter) Close() error {
+	if e == nil {
+		return nil
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.w.Close()
+}
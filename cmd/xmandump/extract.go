@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xbps"
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+)
+
+func init() {
+	subcommands["extract"] = &subcommand{
+		Usage: "extract [-C dir] [-compress | -decompress] package.xbps... -- dump the manpages of package files without repodata",
+		Run:   runExtract,
+	}
+}
+
+func runExtract(args []string) int {
+	var (
+		flagLevel  = zap.WarnLevel
+		dir        = "."
+		compress   bool
+		decompress bool
+	)
+
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.Var(&flagLevel, "v", "log level")
+	fs.StringVar(&dir, "C", dir, "directory to dump manpages to")
+	fs.BoolVar(&compress, "compress", false, "compress files")
+	fs.BoolVar(&decompress, "decompress", false, "decompress .gz, .bz2, and .xz manpages")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fatalf("no package files given")
+	}
+
+	logger, err := NewLogger(zap.NewAtomicLevelAt(flagLevel))
+	if err != nil {
+		return fatalf("unable to create logger: %v", err)
+	}
+	ctx := WithLogger(context.Background(), logger)
+
+	// Resolve package paths before changing to the output directory.
+	files := fs.Args()
+	for i, file := range files {
+		if files[i], err = filepath.Abs(file); err != nil {
+			return fatalf("unable to resolve %s: %v", file, err)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fatalf("unable to create output directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fatalf("unable to change to output directory: %v", err)
+	}
+
+	d := &Dumper{
+		DirMode:       0755,
+		Workers:       semaphore.NewWeighted(1),
+		Compress:      compress,
+		CompressLevel: gzip.DefaultCompression,
+		Decompress:    decompress,
+		Updates:       map[string][]string{},
+	}
+	for _, file := range files {
+		pkg, err := packageFromFile(file)
+		if err != nil {
+			return fatalf("%v", err)
+		}
+		if err := d.processPackage(ctx, pkg, file); err != nil {
+			return fatalf("unable to extract %s: %v", file, err)
+		}
+	}
+
+	for _, p := range d.Written() {
+		fmt.Println(p)
+	}
+	return 0
+}
+
+// packageFromFile describes the package file at file, named in the form
+// <pkgver>.<arch>.xbps, for dumping without repodata.
+func packageFromFile(file string) (*xrepo.Package, error) {
+	base := strings.TrimSuffix(filepath.Base(file), ".xbps")
+	archSep := strings.LastIndexByte(base, '.')
+	if archSep == -1 {
+		return nil, fmt.Errorf("%s: package file name is not of the form <pkgver>.<arch>.xbps", file)
+	}
+	pkgver, err := xbps.ParsePkgVer(base[:archSep])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return &xrepo.Package{
+		PackageVersion: base[:archSep],
+		Name:           pkgver.Name,
+		Version:        pkgver.Version,
+		Revision:       pkgver.Revision,
+		Architecture:   base[archSep+1:],
+		FilenameSHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
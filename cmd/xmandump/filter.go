@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// patternList is a flag.Value for a glob pattern flag that may be given more than once.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(s string) error {
+	if _, err := path.Match(s, ""); err != nil {
+		return err
+	}
+	*p = append(*p, s)
+	return nil
+}
+
+// packageFilter selects packages by name using glob patterns (see path.Match).
+type packageFilter struct {
+	// Include, if not empty, lists patterns of which a package name must match at least one.
+	Include []string
+	// Exclude lists patterns that a package name must not match.
+	Exclude []string
+}
+
+// match returns whether the package name is selected by the filter. A nil filter selects every
+// package.
+func (f *packageFilter) match(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Include) > 0 && !matchAny(f.Include, name) {
+		return false
+	}
+	return !matchAny(f.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readPatternFile reads glob patterns from file, one per line. Blank lines and lines starting with
+// '#' are ignored.
+func readPatternFile(file string) ([]string, error) {
+	p, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for i, line := range strings.Split(string(p), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, i+1, err)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// matchSuffix returns the first of suffixes that name ends with, or an empty string if none do.
+func matchSuffix(suffixes []string, name string) string {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+	return list
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"path"
+	"sort"
+	"strings"
+)
+
+// htmlIndexEntry is a link in a generated HTML index page.
+type htmlIndexEntry struct {
+	Name        string
+	Href        string
+	Description string
+}
+
+// htmlIndex is the content of a generated HTML index page.
+type htmlIndex struct {
+	Title    string
+	Sections []htmlIndexEntry
+	Letters  []htmlIndexEntry
+	Pages    []htmlIndexEntry
+}
+
+var htmlIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{- if .Sections}}
+<h2>Sections</h2>
+<ul>
+{{- range .Sections}}
+<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if .Letters}}
+<p>
+{{- range .Letters}}
+<a href="{{.Href}}">{{.Name}}</a>
+{{- end}}
+</p>
+{{- end}}
+{{- if .Pages}}
+<ul>
+{{- range .Pages}}
+<li><a href="{{.Href}}">{{.Name}}</a>{{if .Description}} &mdash; {{.Description}}{{end}}</li>
+{{- end}}
+</ul>
+{{- end}}
+</body>
+</html>
+`))
+
+// htmlOtherLetter is the letter index used for pages whose names don't start with a letter.
+const htmlOtherLetter = "other"
+
+// writeHTMLIndexes writes static HTML index pages for the manpages in files (slash-separated paths
+// in the output tree): index.html, listing sections and letters; manN/index.html for each
+// section; and index-a.html through index-z.html (and index-other.html) for pages by first
+// letter. Descriptions are taken from metadata, which may be nil. It returns the paths written.
+func writeHTMLIndexes(files []string, metadata *metadataIndex) ([]string, error) {
+	sections := map[string][]htmlIndexEntry{}
+	letters := map[string][]htmlIndexEntry{}
+	for _, p := range indexPages(files) {
+		ref := pathRef(p)
+		entry := htmlIndexEntry{Name: ref, Href: p}
+		if meta := metadata.get(p); meta != nil {
+			entry.Description = meta.Description
+		}
+
+		dir := path.Dir(p)
+		sectionEntry := entry
+		sectionEntry.Href = path.Base(p)
+		sections[dir] = append(sections[dir], sectionEntry)
+
+		letter := strings.ToLower(ref[:1])
+		if letter < "a" || letter > "z" {
+			letter = htmlOtherLetter
+		}
+		letters[letter] = append(letters[letter], entry)
+	}
+
+	root := htmlIndex{Title: "Manual pages"}
+	for _, dir := range sortedEntryKeys(sections) {
+		root.Sections = append(root.Sections, htmlIndexEntry{Name: dir, Href: dir + "/index.html"})
+	}
+	for _, letter := range sortedEntryKeys(letters) {
+		root.Letters = append(root.Letters, htmlIndexEntry{Name: strings.ToUpper(letter), Href: "index-" + letter + ".html"})
+	}
+
+	var written []string
+	write := func(file string, index htmlIndex) error {
+		var buf bytes.Buffer
+		if err := htmlIndexTemplate.Execute(&buf, index); err != nil {
+			return err
+		}
+		if err := writeTreeFile(file, buf.Bytes()); err != nil {
+			return err
+		}
+		written = append(written, file)
+		return nil
+	}
+
+	if err := write("index.html", root); err != nil {
+		return written, err
+	}
+	for _, dir := range sortedEntryKeys(sections) {
+		index := htmlIndex{Title: "Manual pages: " + dir, Pages: sections[dir]}
+		if err := write(path.Join(dir, "index.html"), index); err != nil {
+			return written, err
+		}
+	}
+	for _, letter := range sortedEntryKeys(letters) {
+		index := htmlIndex{Title: "Manual pages: " + strings.ToUpper(letter), Letters: root.Letters, Pages: letters[letter]}
+		if err := write("index-"+letter+".html", index); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// indexPages returns the sorted manpages in files, leaving out generated copies such as
+// plain-text renditions and precompressed siblings of other pages.
+func indexPages(files []string) []string {
+	set := make(map[string]struct{}, len(files))
+	for _, p := range files {
+		set[p] = struct{}{}
+	}
+
+	pages := make([]string, 0, len(files))
+	for p := range set {
+		if strings.HasSuffix(p, textSuffix) || strings.HasSuffix(p, ".br") || pathRef(p) == "" {
+			continue
+		}
+		if trimmed := trimPageCompression(p); trimmed != p {
+			if _, ok := set[trimmed]; ok {
+				continue
+			}
+		}
+		pages = append(pages, p)
+	}
+	sort.Strings(pages)
+	return pages
+}
+
+func sortedEntryKeys(m map[string][]htmlIndexEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"time"
 
 	"go.uber.org/zap"
@@ -11,17 +12,87 @@ var (
 	defaultLogger = zap.NewNop()
 )
 
+// Console log color modes (-color).
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// Console log formats (-log-format).
+const (
+	logFormatFull    = "full"
+	logFormatCompact = "compact"
+)
+
+// logOptions controls how log entries are written. The zero value writes full entries without
+// color to stderr.
+type logOptions struct {
+	Color  string
+	Format string
+	Output string // logOutputStderr (if empty), logOutputJournald, or logOutputSyslog
+
+	// SampleInitial, if positive, is the number of entries with the same level and message logged
+	// each second before sampling starts. After that, every SampleThereafter-th entry is logged.
+	SampleInitial    int
+	SampleThereafter int
+}
+
 func NewLogger(level zap.AtomicLevel) (*zap.Logger, error) {
+	return newLogger(level, logOptions{})
+}
+
+func newLogger(level zap.AtomicLevel, opts logOptions) (*zap.Logger, error) {
 	conf := zap.NewProductionConfig()
 	conf.Level = level
 	conf.Encoding = "console"
 	conf.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	conf.EncoderConfig.EncodeDuration = zapcore.StringDurationEncoder
 	conf.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
-	conf.Sampling = nil // Disable rate limiting -- this is a CLI tool, we don't care too much.
+	conf.Sampling = nil // Disable rate limiting by default -- this is a CLI tool, we don't care too much.
+	if opts.SampleInitial > 0 {
+		conf.Sampling = &zap.SamplingConfig{Initial: opts.SampleInitial, Thereafter: opts.SampleThereafter}
+	}
+	if opts.useColor() {
+		conf.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	}
+	if opts.Format == logFormatCompact {
+		// Only the time of day, and no callers or stack traces, which matter little interactively.
+		conf.EncoderConfig.EncodeTime = func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+			enc.AppendString(t.Format("15:04:05"))
+		}
+		conf.DisableCaller = true
+		conf.DisableStacktrace = true
+	}
+	if opts.Output != "" && opts.Output != logOutputStderr {
+		core, err := newSinkCore(opts.Output, level)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Sampling != nil {
+			core = zapcore.NewSampler(core, time.Second, conf.Sampling.Initial, conf.Sampling.Thereafter)
+		}
+		return zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)), nil
+	}
 	return conf.Build()
 }
 
+// useColor returns whether log levels are colored. In auto mode, they are only colored if stderr is
+// a terminal and neither NO_COLOR nor TERM=dumb is set.
+func (o logOptions) useColor() bool {
+	switch o.Color {
+	case colorAlways:
+		return true
+	case colorAuto:
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false
+		}
+		fi, err := os.Stderr.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0
+	}
+	return false
+}
+
 func logRepoData(file string) zap.Field {
 	return zap.String("repodata", file)
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Log outputs (-log-output).
+const (
+	logOutputStderr   = "stderr"
+	logOutputJournald = "journald"
+	logOutputSyslog   = "syslog"
+)
+
+// journalSocket is the socket of journald's native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// newSinkCore returns a core writing log entries at level to journald or syslog.
+func newSinkCore(output string, level zapcore.LevelEnabler) (zapcore.Core, error) {
+	ident := filepath.Base(os.Args[0])
+	switch output {
+	case logOutputJournald:
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		return &journalCore{LevelEnabler: level, conn: conn, ident: ident}, nil
+	case logOutputSyslog:
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, ident)
+		if err != nil {
+			return nil, err
+		}
+		enc := zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
+			MessageKey:     "msg",
+			EncodeDuration: zapcore.StringDurationEncoder,
+		})
+		return &syslogCore{LevelEnabler: level, enc: enc, w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown log output %q", output)
+}
+
+// journalCore writes log entries to journald using its native protocol. Fields are sent as journal
+// fields, with names uppercased (e.g., "file" becomes FILE), so they can be matched by journalctl.
+type journalCore struct {
+	zapcore.LevelEnabler
+	conn   *net.UnixConn
+	ident  string
+	fields []zapcore.Field
+}
+
+func (c *journalCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = append(append([]zapcore.Field(nil), c.fields...), fields...)
+	return &clone
+}
+
+func (c *journalCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *journalCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", ent.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(int(syslogPriority(ent.Level))))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", c.ident)
+	if ent.Caller.Defined {
+		writeJournalField(&buf, "CODE_FILE", ent.Caller.File)
+		writeJournalField(&buf, "CODE_LINE", strconv.Itoa(ent.Caller.Line))
+	}
+	if ent.Stack != "" {
+		writeJournalField(&buf, "STACKTRACE", ent.Stack)
+	}
+
+	keys := make([]string, 0, len(enc.Fields))
+	for key := range enc.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var value string
+		switch v := enc.Fields[key].(type) {
+		case string:
+			value = v
+		case time.Duration:
+			value = v.String()
+		default:
+			p, err := json.Marshal(v)
+			if err != nil {
+				value = fmt.Sprint(v)
+			} else {
+				value = string(p)
+			}
+		}
+		writeJournalField(&buf, journalFieldName(key), value)
+	}
+
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *journalCore) Sync() error {
+	return nil
+}
+
+// writeJournalField writes a field in journald's native format. Values with newlines are written
+// with an explicit length.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// journalFieldName converts a log field key to a valid journal field name: uppercase letters, digits,
+// and underscores, not starting with an underscore or digit.
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	s := strings.TrimLeft(string(name), "_")
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		s = "F_" + s
+	}
+	return s
+}
+
+// syslogCore writes log entries to the system logger, with fields appended to the message.
+type syslogCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	w   *syslog.Writer
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.enc = c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(clone.enc)
+	}
+	return &clone
+}
+
+func (c *syslogCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *syslogCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(buf.String(), "\n")
+	buf.Free()
+
+	switch syslogPriority(ent.Level) {
+	case syslog.LOG_DEBUG:
+		return c.w.Debug(msg)
+	case syslog.LOG_INFO:
+		return c.w.Info(msg)
+	case syslog.LOG_WARNING:
+		return c.w.Warning(msg)
+	case syslog.LOG_ERR:
+		return c.w.Err(msg)
+	default:
+		return c.w.Crit(msg)
+	}
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
+
+// syslogPriority returns the syslog priority of a log level.
+func syslogPriority(level zapcore.Level) syslog.Priority {
+	switch level {
+	case zapcore.DebugLevel:
+		return syslog.LOG_DEBUG
+	case zapcore.InfoLevel:
+		return syslog.LOG_INFO
+	case zapcore.WarnLevel:
+		return syslog.LOG_WARNING
+	case zapcore.ErrorLevel:
+		return syslog.LOG_ERR
+	}
+	return syslog.LOG_CRIT
+}
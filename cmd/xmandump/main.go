@@ -14,30 +14,54 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
+	"runtime/trace"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
 
-	"github.com/gabriel-vasile/mimetype"
 	"github.com/klauspost/compress/zstd"
-	"github.com/ulikunitz/xz"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
-	"howett.net/plist"
 )
 
 const (
 	cacheVersion = 1
+
+	// Policies for packages whose compression format is not supported.
+	unknownFormatFail = "fail"
+	unknownFormatSkip = "skip"
+
+	// defaultSkipSuffixes are the name suffixes of packages ignored by default: debug symbols and
+	// 32-bit compatibility packages never contain manpages of their own.
+	defaultSkipSuffixes = "-dbg,-32bit"
+
+	// memoryPerPackage is a rough estimate of the memory needed to process a single package
+	// (decompressor window and buffers). It is used to fit concurrency to -max-memory.
+	memoryPerPackage = 64 << 20
 )
 
 type cacheRecords struct {
 	Version int                 `json:"version"`
 	Cache   map[string][]string `json:"cache-v1"`
+	// Repos maps the keys of Cache to the repository each package came from.
+	Repos map[string]string `json:"repos-v1,omitempty"`
+	// Repodata maps the absolute path of each repodata file processed to its SHA-256 hash.
+	Repodata map[string]string `json:"repodata-v1,omitempty"`
+	// Options is a hash of the options that affect the output of the run that wrote Repodata.
+	Options string `json:"options-v1,omitempty"`
+	// Generated lists the files other than manpages written to the output tree, such as HTML
+	// indexes, so that those a later run no longer writes can be removed.
+	Generated []string `json:"generated-v1,omitempty"`
 }
 
 func main() {
@@ -50,12 +74,106 @@ func main() {
 		ctx                   = context.Background()
 		flagMode       string = "755"
 		fileMode       os.FileMode
+		flagPageMode   string
 		cacheFile      string
 		cache          cacheRecords
 		compress       bool
+		decompress     bool
+		precompress    bool
+		renderText     bool
+		mandocPath     = "mandoc"
+		metadataFile   string
+		seeAlsoFile    string
+		whatisTool     string
+		htmlIndex      bool
+		sitemap        bool
+		baseURL        string
+		provenanceFile string
+		reverseIndex   string
+		manifestFile   string
+		conflictsFile  string
+		dedupStore     string
+		shareDir       string
+		shareSymlinks  bool
+		reproducible   bool
+		preserveMtime  bool
+		ownerSpec      string
+		includes       patternList
+		excludes       patternList
+		force          bool
+		forcePackages  patternList
+		repair         bool
+		plan           bool
+		since          string
+		sinceLastRun   bool
+		cutoff         time.Time
+		includeFrom    string
+		repoLayout     = repoLayoutMerge
+		splitByRepo    bool
+		repoPriority   string
+		repoRoot       string
+		repoIncludes   patternList
+		rootfs         string
+		pkgDir         string
+		repoExcludes   patternList
+		skipSuffixes   = defaultSkipSuffixes
+		excludeFrom    string
 		removeOldFiles bool
 		cpuprofile     string
 		memprofile     string
+		blockprofile   string
+		mutexprofile   string
+		traceFile      string
+		slowest        = 10
+		rsyncFilesFrom string
+		rsyncFilter    string
+		publishDir     string
+		squashfsImage  string
+		syncCommand    string
+		postgresDSN    string
+		psqlPath       = "psql"
+		searchURL      string
+		searchEngine   = searchEngineMeilisearch
+		searchIndexUID = "manpages"
+		statusAddr     string
+		s3Endpoint     string
+		s3BucketName   string
+		s3Prefix       string
+		s3Region       = "us-east-1"
+		mksquashfsPath = "mksquashfs"
+		signKey        string
+		signTool       string = signToolSignify
+		configFile     string
+		profileName    string
+		showTUI        bool
+		sandbox        bool
+		eventsDest     string
+		runUser        string
+		runGroup       string
+		plistMemLimit  int64 = defaultPlistMemLimit
+		maxMemory      byteSize
+		minFree        byteSize
+		writeRate      byteSize
+		keepGoing      bool
+		logColor       = colorAuto
+		noColor        bool
+		logFormat      = logFormatFull
+		logOutput      = logOutputStderr
+		logSample      int
+		logSampleAfter = 100
+		maxErrors      int64
+		workers        int64 = int64(runtime.NumCPU())
+		repoLimit      int
+		useMmap        bool
+		zstdWorkers    int
+		zstdMaxWindow  byteSize
+		unknownFormat  = unknownFormatFail
+		compressLevel  = gzip.DefaultCompression
+
+		chaosFailRate    float64
+		chaosSlowRead    time.Duration
+		chaosENOSPCAfter int64
+		chaosSeed        int64
 	)
 
 	maxLimit, limErr := getFileLimit()
@@ -67,18 +185,157 @@ func main() {
 		flagMode = fmt.Sprintf("%03o", uint32(stat.Mode()&0x1ff))
 	}
 
+	flag.StringVar(&rsyncFilesFrom, "rsync-files-from", "", "write changed files to an rsync --files-from list")
+	flag.StringVar(&rsyncFilter, "rsync-filter", "", "write changed and removed files to an rsync filter file")
+	flag.StringVar(&squashfsImage, "squashfs", "", "build a squashfs image of the output tree at this path, replacing it atomically")
+	flag.StringVar(&mksquashfsPath, "mksquashfs", mksquashfsPath, "mksquashfs command used by -squashfs")
+	flag.StringVar(&postgresDSN, "postgres", "", "export packages and manpages to the PostgreSQL database with this connection string after each run (prefer PGPASSWORD or ~/.pgpass for passwords)")
+	flag.StringVar(&psqlPath, "psql", psqlPath, "psql command used by -postgres")
+	flag.StringVar(&searchURL, "search-url", "", "URL of a search service to push written and removed manpages to (the API key is read from XMANDUMP_SEARCH_KEY)")
+	flag.StringVar(&searchEngine, "search-engine", searchEngine, "search service used by -search-url (meilisearch or elasticsearch)")
+	flag.StringVar(&searchIndexUID, "search-index", searchIndexUID, "name of the index used by -search-url")
+	flag.StringVar(&syncCommand, "sync-command", "", "shell command run in the output directory to upload it (e.g., rsync or rclone); the cache is only written if it succeeds")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "URL of an S3-compatible service to sync the output tree to (credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	flag.StringVar(&s3BucketName, "s3-bucket", "", "bucket to sync the output tree to (requires -s3-endpoint)")
+	flag.StringVar(&s3Prefix, "s3-prefix", "", "prefix of object keys in the bucket, e.g. x86_64/")
+	flag.StringVar(&s3Region, "s3-region", s3Region, "region used to sign object storage requests")
+	flag.StringVar(&publishDir, "publish", "", "publish the output tree to a directory on the same filesystem using hardlinks")
+	flag.Float64Var(&chaosFailRate, "chaos-fail-rate", 0, "fraction of packages to fail (testing only)")
+	flag.DurationVar(&chaosSlowRead, "chaos-slow-read", 0, "delay every package read (testing only)")
+	flag.Int64Var(&chaosENOSPCAfter, "chaos-enospc-after", 0, "fail writes with ENOSPC after this many bytes (testing only)")
+	flag.Int64Var(&chaosSeed, "chaos-seed", 0, "random seed for failure injection (testing only)")
+	flag.BoolVar(&keepGoing, "k", false, "keep going when a package fails, exiting with an error at the end")
+	flag.Int64Var(&maxErrors, "max-errors", 0, "with -k, abort once this many packages have failed (0 for no limit)")
+	flag.Var(&writeRate, "write-rate", "limit manpage writes to this many bytes per second (e.g., 10M)")
+	flag.Var(&minFree, "min-free", "abort before extraction unless this much space (e.g., 1G) would remain free in the output directory")
+	flag.Var(&maxMemory, "max-memory", "soft memory limit (e.g., 2G); also lowers -L to fit")
+	flag.Int64Var(&plistMemLimit, "plist-mem-limit", plistMemLimit, "buffer files lists larger than this many bytes in a temporary file")
+	flag.StringVar(&runUser, "user", "", "switch to this user after starting")
+	flag.StringVar(&runGroup, "group", "", "switch to this group after starting (default: the user's group)")
+	flag.StringVar(&eventsDest, "events", "", "write NDJSON events to a file or file descriptor")
+	flag.BoolVar(&sandbox, "sandbox", false, "restrict writes to the output directory and output files (Linux only, requires a binary built with CGO_ENABLED=0)")
+	flag.StringVar(&statusAddr, "status-addr", "", "serve /healthz and /status over HTTP at this address (e.g., localhost:9090) during the run")
+	flag.BoolVar(&showTUI, "tui", false, "show live progress in the terminal instead of logging")
+	flag.StringVar(&configFile, "config", "", "configuration file")
+	flag.StringVar(&profileName, "profile", "", "use the named profile from the configuration file")
+	flag.StringVar(&signKey, "sign-key", "", "sign the cache file with this secret key")
+	flag.StringVar(&signTool, "sign-tool", signTool, "tool used to sign the cache file (signify or minisign)")
 	flag.StringVar(&memprofile, "memprofile", "", "write to mem profile file")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "write to cpu profile file")
+	flag.StringVar(&blockprofile, "blockprofile", "", "write to goroutine blocking profile file")
+	flag.StringVar(&mutexprofile, "mutexprofile", "", "write to mutex contention profile file")
+	flag.StringVar(&traceFile, "trace", "", "write to execution trace file")
+	flag.IntVar(&slowest, "slowest", slowest, "number of slowest packages to report with package timings")
 	flag.BoolVar(&removeOldFiles, "b", false, "remove old files")
 	flag.BoolVar(&compress, "compress", false, "compress files")
+	flag.IntVar(&compressLevel, "compress-level", compressLevel, "gzip level used by -compress (1-9, or -1 for the default)")
+	flag.BoolVar(&decompress, "decompress", false, "decompress .gz, .bz2, and .xz manpages")
+	flag.StringVar(&metadataFile, "metadata", "", "maintain a JSON index of manpage titles, sections, and descriptions")
+	flag.StringVar(&seeAlsoFile, "see-also", "", "write a JSON graph of SEE ALSO references (requires -metadata)")
+	flag.StringVar(&whatisTool, "whatis", "", "build an apropos database over the output tree using this tool (makewhatis or mandb)")
+	flag.BoolVar(&htmlIndex, "html-index", false, "write static HTML index pages by section and by letter")
+	flag.BoolVar(&sitemap, "sitemap", false, "write a sitemap.xml of all manpages (requires -base-url)")
+	flag.StringVar(&baseURL, "base-url", "", "URL the output tree is served from, used by -sitemap")
+	flag.StringVar(&provenanceFile, "provenance", "", "write a JSON file of the packages each manpage came from")
+	flag.StringVar(&reverseIndex, "reverse-index", "", "write a JSON file mapping each manpage to the packages providing it")
+	flag.StringVar(&manifestFile, "manifest", "", "write a JSON file mapping each package's pkgver to its manpages")
+	flag.StringVar(&conflictsFile, "conflicts", "", "write a JSON report of manpages provided by more than one package")
+	flag.StringVar(&shareDir, "share-with", "", "link manpages identical to those at the same path in this other output tree (e.g., glibc's tree when dumping musl) to them")
+	flag.BoolVar(&shareSymlinks, "share-symlinks", false, "use absolute symlinks instead of hard links for -share-with")
+	flag.StringVar(&dedupStore, "dedup", "", "hard link identical manpages to a content-addressed store in this directory (same filesystem)")
+	flag.BoolVar(&reproducible, "reproducible", false, "produce the same tree and cache from the same repodata (processes one package at a time)")
+	flag.BoolVar(&preserveMtime, "preserve-mtime", false, "set modification times of extracted files from the package archive")
+	flag.StringVar(&ownerSpec, "owner", "", "set the owner of created files and directories to user[:group] (requires root)")
+	flag.StringVar(&repoLayout, "repo-layout", repoLayout, "layout of manpages from multiple repositories (merge or split into per-repository directories)")
+	flag.BoolVar(&splitByRepo, "split-by-repo", false, "write manpages from each repository to its own directory (same as -repo-layout split)")
+	flag.StringVar(&repoPriority, "repo-priority", "", "comma-separated repositories, highest priority first, deciding which repository's copy of a manpage is kept when merging (e.g., current,nonfree)")
+	flag.StringVar(&repoRoot, "repo-root", "", "directory that repositories are named relative to (e.g., current, naming current/nonfree \"nonfree\"); required by -repo-layout split and -repo-priority")
+	flag.StringVar(&pkgDir, "pkgdir", "", "read package files from this directory (e.g., xbps's /var/cache/xbps) instead of beside their repodata")
+	flag.StringVar(&rootfs, "rootfs", "", "dump the manpages installed in this root filesystem instead of those in repodata files")
+	flag.Var(&repoIncludes, "repodata-include", "only use repodata files found in directory arguments whose paths match this glob (repeatable)")
+	flag.Var(&repoExcludes, "repodata-exclude", "skip repodata files found in directory arguments whose paths match this glob (repeatable)")
+	flag.StringVar(&skipSuffixes, "skip-suffixes", skipSuffixes, "comma-separated package name suffixes to ignore (empty to ignore none)")
+	flag.Var(&includes, "include", "only process packages whose names match this glob (repeatable)")
+	flag.Var(&excludes, "exclude", "skip packages whose names match this glob (repeatable)")
+	flag.StringVar(&includeFrom, "include-from", "", "read -include patterns from a file, one per line")
+	flag.StringVar(&excludeFrom, "exclude-from", "", "read -exclude patterns from a file, one per line")
+	flag.BoolVar(&force, "force", false, "extract all packages again, even if they are in the cache")
+	flag.StringVar(&since, "since", "", "skip packages built before this date (YYYY-MM-DD or RFC 3339)")
+	flag.BoolVar(&sinceLastRun, "since-last-run", false, "skip packages built before the cache file was last written")
+	flag.BoolVar(&plan, "plan", false, "print the files a run would create, overwrite, and delete as JSON without changing anything")
+	flag.BoolVar(&repair, "repair", false, "extract packages again whose files in the cache are missing or damaged in the output tree")
+	flag.Var(&forcePackages, "force-package", "extract packages whose names match this glob again, even if they are in the cache (repeatable)")
+	flag.BoolVar(&renderText, "text", false, "also render each manpage to a .txt file using mandoc")
+	flag.StringVar(&mandocPath, "mandoc", mandocPath, "mandoc command used by -text")
+	flag.BoolVar(&precompress, "precompress", false, "also write .gz and .br copies of each manpage for web serving")
 	flag.StringVar(&cacheFile, "c", "", "cache file")
 	flag.StringVar(&flagMode, "m", flagMode, "directory permissions")
+	flag.StringVar(&flagPageMode, "M", "", "manpage file permissions, regardless of umask (default: 666 less umask)")
 	flag.Var(&flagLevel, "v", "log level")
+	flag.StringVar(&logColor, "color", logColor, "color log levels (auto, always, or never)")
+	flag.BoolVar(&noColor, "no-color", false, "don't color log levels (same as -color never)")
+	flag.StringVar(&logOutput, "log-output", logOutput, "where to write logs (stderr, journald, or syslog)")
+	flag.IntVar(&logSample, "log-sample", 0, "log at most this many entries with the same message per second before sampling them (0 to log all)")
+	flag.IntVar(&logSampleAfter, "log-sample-thereafter", logSampleAfter, "with -log-sample, log every Nth entry with the same message after that")
+	flag.StringVar(&logFormat, "log-format", logFormat, "log entry format (full, or compact for interactive use)")
 	flag.Int64Var(&openLimit, "L", openLimit, "concurrent file limit")
+	flag.Int64Var(&workers, "j", workers, "concurrent decompression workers")
+	flag.IntVar(&zstdWorkers, "zstd-concurrency", 0, "concurrent decoders per zstd package (0 for GOMAXPROCS)")
+	flag.Var(&zstdMaxWindow, "zstd-max-window", "maximum zstd window size, e.g. 8M (0 for no limit)")
+	flag.StringVar(&unknownFormat, "unknown-format", unknownFormat, "policy for packages with unsupported compression (fail or skip)")
+	flag.BoolVar(&useMmap, "mmap", false, "memory-map package files instead of reading them")
+	flag.IntVar(&repoLimit, "R", 0, "concurrent repodata files, with packages scheduled round-robin (0 for all)")
+	flag.Usage = usage
+	runSubcommand(os.Args[1:])
 	flag.Parse()
 
+	args := flag.Args()
+	if profileName != "" {
+		if configFile == "" {
+			fmt.Fprintf(os.Stderr, "Fatal error: -profile requires a configuration file (-config)\n")
+			os.Exit(1)
+		}
+		conf, err := loadConfig(configFile)
+		if err == nil {
+			args, err = conf.applyProfile(flag.CommandLine, profileName, args)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Fatal error: unable to load configuration: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// The TUI replaces console logs -- errors are shown in its error pane instead.
+	if showTUI && flagLevel < zap.FatalLevel {
+		flagLevel = zap.FatalLevel
+	}
+
+	if noColor {
+		logColor = colorNever
+	}
+	if logColor != colorAuto && logColor != colorAlways && logColor != colorNever {
+		fmt.Fprintf(os.Stderr, "Fatal error: invalid -color %q: must be auto, always, or never\n", logColor)
+		os.Exit(1)
+	} else if logFormat != logFormatFull && logFormat != logFormatCompact {
+		fmt.Fprintf(os.Stderr, "Fatal error: invalid -log-format %q: must be full or compact\n", logFormat)
+		os.Exit(1)
+	} else if logOutput != logOutputStderr && logOutput != logOutputJournald && logOutput != logOutputSyslog {
+		fmt.Fprintf(os.Stderr, "Fatal error: invalid -log-output %q: must be stderr, journald, or syslog\n", logOutput)
+		os.Exit(1)
+	} else if logSampleAfter < 1 {
+		fmt.Fprintf(os.Stderr, "Fatal error: invalid -log-sample-thereafter: must be >= 1\n")
+		os.Exit(1)
+	}
+
 	logLevel := zap.NewAtomicLevelAt(flagLevel)
-	logger, err := NewLogger(logLevel)
+	logger, err := newLogger(logLevel, logOptions{
+		Color:  logColor,
+		Format: logFormat,
+		Output: logOutput,
+
+		SampleInitial:    logSample,
+		SampleThereafter: logSampleAfter,
+	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Fatal error: unable to create logger: %v\n", err)
 		os.Exit(1)
@@ -86,9 +343,106 @@ func main() {
 
 	defer func() { logger.Info("Done", timer()) }()
 
+	// Report progress to systemd (if running as a Type=notify service). Notifications stop on every
+	// exit, including fatal errors.
+	status := newRunStatus()
+	notifier, err := startSystemdNotifier(status)
+	if err != nil {
+		logger.Warn("Unable to notify systemd", zap.Error(err))
+	}
+	defer notifier.Stop()
+	logger = logger.WithOptions(zap.Hooks(func(ent zapcore.Entry) error {
+		if ent.Level == zapcore.FatalLevel {
+			notifier.Stop()
+		}
+		return nil
+	}))
+
 	zap.ReplaceGlobals(logger)
 	ctx = WithLogger(ctx, logger)
 
+	// Package name filter (if set)
+	if includeFrom != "" {
+		patterns, err := readPatternFile(includeFrom)
+		if err != nil {
+			logger.Fatal("Unable to read include patterns", logFile(includeFrom), zap.Error(err))
+		}
+		includes = append(includes, patterns...)
+	}
+	if excludeFrom != "" {
+		patterns, err := readPatternFile(excludeFrom)
+		if err != nil {
+			logger.Fatal("Unable to read exclude patterns", logFile(excludeFrom), zap.Error(err))
+		}
+		excludes = append(excludes, patterns...)
+	}
+	var filter *packageFilter
+	if len(includes) > 0 || len(excludes) > 0 {
+		filter = &packageFilter{Include: includes, Exclude: excludes}
+	}
+	if force {
+		forcePackages = patternList{"*"}
+	}
+
+	// Set up object storage (if set)
+	var bucket *s3Bucket
+	if s3Endpoint != "" || s3BucketName != "" {
+		if bucket, err = newS3Bucket(s3Endpoint, s3BucketName, s3Prefix, s3Region); err != nil {
+			logger.Fatal("Invalid object storage configuration", zap.Error(err))
+		}
+	}
+
+	// Set up search index (if set)
+	// The connection string is passed to psql through its environment (if set)
+	var postgresEnv []string
+	if postgresDSN != "" {
+		if postgresEnv, err = postgresEnviron(postgresDSN); err != nil {
+			logger.Fatal("Invalid PostgreSQL connection string", zap.Error(err))
+		}
+	}
+
+	var search *searchIndex
+	if searchURL != "" {
+		if search, err = newSearchIndex(searchEngine, searchURL, searchIndexUID); err != nil {
+			logger.Fatal("Invalid search index configuration", zap.Error(err))
+		}
+	}
+
+	if rootfs != "" && len(args) > 0 {
+		logger.Fatal("Cannot use -rootfs with repodata files")
+	}
+
+	// Expand globs and find repodata files in directory arguments
+	var repoFilter *packageFilter
+	if len(repoIncludes) > 0 || len(repoExcludes) > 0 {
+		repoFilter = &packageFilter{Include: repoIncludes, Exclude: repoExcludes}
+	}
+	if args, err = expandGlobs(args); err != nil {
+		logger.Fatal("Unable to expand repodata arguments", zap.Error(err))
+	}
+	if args, err = findRepoData(args, repoFilter); err != nil {
+		logger.Fatal("Unable to find repodata files", zap.Error(err))
+	}
+
+	// Resolve owner of created files (if set)
+	var owner *fileOwner
+	if ownerSpec != "" {
+		if runUser != "" || runGroup != "" {
+			logger.Fatal("Cannot use -owner with -user or -group")
+		}
+		if owner, err = parseOwner(ownerSpec); err != nil {
+			logger.Fatal("Invalid owner", zap.String("owner", ownerSpec), zap.Error(err))
+		}
+	}
+
+	// Drop privileges (if set)
+	if runUser != "" || runGroup != "" {
+		if err := dropPrivileges(runUser, runGroup); err != nil {
+			logger.Fatal("Unable to drop privileges", zap.String("user", runUser), zap.String("group", runGroup), zap.Error(err))
+		}
+		logger.Debug("Dropped privileges", zap.Int("uid", os.Getuid()), zap.Int("gid", os.Getgid()))
+	}
+
 	// Start CPU profiling (if set)
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
@@ -102,6 +456,27 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	// Start execution tracing (if set)
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			logger.Fatal("Failed to create trace file", zap.Error(err))
+		}
+		defer f.Close()
+		if err := trace.Start(f); err != nil {
+			logger.Fatal("Failed to start trace", zap.Error(err))
+		}
+		defer trace.Stop()
+	}
+
+	// Record blocking and mutex contention events for their profiles (if set)
+	if blockprofile != "" {
+		runtime.SetBlockProfileRate(1)
+	}
+	if mutexprofile != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+
 	// Load cache (if any)
 	if cacheFile != "" {
 		p, err := ioutil.ReadFile(cacheFile)
@@ -116,6 +491,43 @@ func main() {
 		}
 	}
 
+	// Build date cutoff (if set)
+	if since != "" && sinceLastRun {
+		logger.Fatal("Cannot use -since with -since-last-run")
+	} else if since != "" {
+		if cutoff, err = time.Parse("2006-01-02", since); err != nil {
+			if cutoff, err = time.Parse(time.RFC3339, since); err != nil {
+				logger.Fatal("Invalid -since date -- must be YYYY-MM-DD or RFC 3339", zap.String("since", since))
+			}
+		}
+	} else if sinceLastRun {
+		if cacheFile == "" {
+			logger.Fatal("Cannot use -since-last-run without a cache file")
+		}
+		if fi, err := os.Stat(cacheFile); err == nil {
+			cutoff = fi.ModTime()
+		} else if !os.IsNotExist(err) {
+			logger.Fatal("Unable to stat cache file", logFile(cacheFile), zap.Error(err))
+		}
+	}
+
+	// Exit early if no repodata or options changed since the last run. Runs that extract cached
+	// packages again or don't write the cache always go ahead.
+	var repodata map[string]string
+	options := optionsFingerprint(flag.CommandLine)
+	if rootfs == "" {
+		if repodata, err = repoDataHashes(args); err != nil {
+			// Leave errors to be reported when the repodata is processed.
+			logger.Debug("Unable to hash repodata", zap.Error(err))
+			repodata = nil
+		}
+	}
+	if cacheFile != "" && !plan && !repair && len(forcePackages) == 0 &&
+		cache.Options == options && sameRepoData(repodata, cache.Repodata) {
+		logger.Info("Repodata and options unchanged since last run, nothing to do", logFile(cacheFile))
+		return
+	}
+
 	switch cache.Version {
 	// TODO: Add migration of other cache versions' data where relevant.
 	case 0, cacheVersion: // Nothing
@@ -130,6 +542,48 @@ func main() {
 	}
 	fileMode = os.FileMode(parsedMode)
 
+	// Parse page file mode (if set)
+	var pageMode os.FileMode
+	if flagPageMode != "" {
+		parsedMode, err := strconv.ParseUint(flagPageMode, 8, 32)
+		if err != nil {
+			logger.Fatal("Invalid page file mode: cannot be parsed", zap.Error(err))
+		} else if parsedMode == 0 || parsedMode > 0777 {
+			logger.Fatal("Invalid page file mode: must be between 1 and 777")
+		}
+		pageMode = os.FileMode(parsedMode)
+	}
+
+	// Check signing options
+	if signKey != "" {
+		if cacheFile == "" {
+			logger.Fatal("Signing requires a cache file (-c)")
+		} else if !validSignTool(signTool) {
+			logger.Fatal("Invalid signing tool", zap.String("tool", signTool))
+		}
+	}
+
+	// Apply memory limit (if set)
+	if maxMemory > 0 {
+		debug.SetMemoryLimit(int64(maxMemory))
+		if limit := int64(maxMemory) / memoryPerPackage * 2; limit < openLimit {
+			if limit < 2 {
+				limit = 2
+			}
+			logger.Info("Lowering concurrent file limit to fit memory limit",
+				zap.Int64("limit", limit), zap.Int64("max_memory", int64(maxMemory)))
+			openLimit = limit
+		}
+		if limit := int64(maxMemory) / memoryPerPackage; limit < workers {
+			if limit < 1 {
+				limit = 1
+			}
+			logger.Info("Lowering decompression workers to fit memory limit",
+				zap.Int64("workers", limit), zap.Int64("max_memory", int64(maxMemory)))
+			workers = limit
+		}
+	}
+
 	// Check limit
 	if openLimit < 2 {
 		logger.Fatal("Invalid limit -- must be >= 2", zap.Int64("limit", openLimit))
@@ -137,17 +591,177 @@ func main() {
 		logger.Fatal("Invalid limit -- must be <= nofiles", zap.Int64("nofiles", maxLimit), zap.Int64("limit", openLimit))
 	}
 
-	// Semaphore controls no. of open files via goroutines -- all acquisitions have a weight of
-	// 2 -- one for the package, one for a new file.
-	sema := semaphore.NewWeighted(openLimit)
-	wg, ctx := errgroup.WithContext(ctx)
+	if workers < 1 {
+		logger.Fatal("Invalid number of workers -- must be >= 1", zap.Int64("workers", workers))
+	}
+
+	if compressLevel != gzip.DefaultCompression && (compressLevel < gzip.BestSpeed || compressLevel > gzip.BestCompression) {
+		logger.Fatal("Invalid compression level -- must be 1-9 or -1", zap.Int("level", compressLevel))
+	}
+
+	if whatisTool != "" && !validWhatisTool(whatisTool) {
+		logger.Fatal("Invalid apropos database tool -- must be makewhatis or mandb", zap.String("tool", whatisTool))
+	}
+
+	if sitemap && baseURL == "" {
+		logger.Fatal("-sitemap requires -base-url")
+	}
+
+	if seeAlsoFile != "" && metadataFile == "" {
+		logger.Fatal("-see-also requires -metadata")
+	}
+
+	if shareDir != "" && dedupStore != "" {
+		logger.Fatal("Cannot use -share-with with -dedup")
+	}
+
+	if precompress && compress {
+		logger.Fatal("Cannot use -precompress with -compress")
+	}
+
+	if sandbox && cgoEnabled {
+		logger.Fatal("-sandbox requires a binary built without cgo (CGO_ENABLED=0)")
+	}
+
+	if splitByRepo {
+		repoLayout = repoLayoutSplit
+	}
+
+	if repoLayout != repoLayoutMerge && repoLayout != repoLayoutSplit {
+		logger.Fatal("Invalid repository layout -- must be merge or split", zap.String("layout", repoLayout))
+	} else if repoRoot == "" && (repoLayout == repoLayoutSplit || repoPriority != "") {
+		// Without a root, every repository has the same name.
+		logger.Fatal("-repo-layout split and -repo-priority require -repo-root")
+	}
+
+	if unknownFormat != unknownFormatFail && unknownFormat != unknownFormatSkip {
+		logger.Fatal("Invalid unknown format policy -- must be fail or skip", zap.String("policy", unknownFormat))
+	}
+
+	// zstd decoder options
+	var zstdOpts []zstd.DOption
+	if zstdWorkers < 0 {
+		logger.Fatal("Invalid zstd concurrency -- must be >= 0", zap.Int("concurrency", zstdWorkers))
+	} else if zstdWorkers > 0 {
+		zstdOpts = append(zstdOpts, zstd.WithDecoderConcurrency(zstdWorkers))
+	}
+	if zstdMaxWindow > 0 {
+		zstdOpts = append(zstdOpts, zstd.WithDecoderMaxMemory(uint64(zstdMaxWindow)))
+	}
+
+	// Open event stream (if set)
+	var events *eventWriter
+	if eventsDest != "" {
+		if events, err = openEventWriter(eventsDest); err != nil {
+			logger.Fatal("Unable to open event stream", zap.String("events", eventsDest), zap.Error(err))
+		}
+		defer events.Close()
+	}
+
+	// Load metadata index (if set)
+	var metadata *metadataIndex
+	if metadataFile != "" {
+		if metadata, err = loadMetadataIndex(metadataFile); err != nil {
+			logger.Fatal("Unable to load metadata index", logFile(metadataFile), zap.Error(err))
+		}
+	}
+
+	// Restrict filesystem writes (if set)
+	if sandbox {
+		writable := []string{".", os.TempDir()}
+		for _, file := range []string{cacheFile, rsyncFilesFrom, rsyncFilter, memprofile, blockprofile, mutexprofile, metadataFile, seeAlsoFile, provenanceFile, reverseIndex, manifestFile, conflictsFile, squashfsImage} {
+			if file != "" {
+				writable = append(writable, filepath.Dir(file))
+			}
+		}
+		if dedupStore != "" {
+			if err := os.MkdirAll(dedupStore, fileMode); err != nil {
+				logger.Fatal("Unable to create dedup store", logFile(dedupStore), zap.Error(err))
+			}
+			writable = append(writable, dedupStore)
+		}
+		if shareDir != "" && !shareSymlinks {
+			// Landlock refuses hard links to files outside of the writable paths.
+			writable = append(writable, shareDir)
+		}
+		if publishDir != "" {
+			if err := os.MkdirAll(publishDir, fileMode); err != nil {
+				logger.Fatal("Unable to create publish directory", logFile(publishDir), zap.Error(err))
+			}
+			writable = append(writable, publishDir)
+		}
+		// -dedup, -publish, and -share-with (with hard links) link files across directories.
+		refer := dedupStore != "" || publishDir != "" || shareDir != "" && !shareSymlinks
+		if err := enterSandbox(writable, refer); err != nil {
+			if refer {
+				logger.Fatal("Unable to enter sandbox with -dedup, -publish, or -share-with", zap.Error(err))
+			}
+			logger.Fatal("Unable to enter sandbox", zap.Error(err))
+		}
+		logger.Debug("Entered sandbox", zap.Strings("writable", writable))
+	}
+
+	names, err := repoNames(repoRoot, args)
+	if err != nil {
+		logger.Fatal("Invalid repository root", zap.Error(err))
+	}
 
 	dumper := &Dumper{
 		DirMode:  fileMode,
-		Sema:     sema,
+		FileMode: pageMode,
+		Workers:  semaphore.NewWeighted(workers),
 		Cache:    cache.Cache,
 		Compress: compress,
 		Updates:  map[string][]string{},
+		Status:   status,
+		Events:   events,
+		Chaos:    newChaos(chaosFailRate, chaosSlowRead, chaosENOSPCAfter, chaosSeed),
+		Metadata: metadata,
+		Timings:  &packageTimings{},
+		Phases:   &phaseTimings{},
+
+		DedupStore:    dedupStore,
+		ShareDir:      shareDir,
+		ShareSymlinks: shareSymlinks,
+		Reproducible:  reproducible,
+
+		PreserveMtime: preserveMtime,
+		Owner:         owner,
+		Filter:        filter,
+		Force:         forcePackages,
+		Since:         cutoff,
+		Plan:          plan,
+		SkipSuffixes:  splitList(skipSuffixes),
+		RepoNames:     names,
+		SplitRepos:    repoLayout == repoLayoutSplit,
+		RepoPriority:  splitList(repoPriority),
+		PackageDir:    pkgDir,
+
+		PlistMemLimit: plistMemLimit,
+		WriteLimit:    newWriteLimiter(int64(writeRate)),
+		MinFree:       int64(minFree),
+		KeepGoing:     keepGoing,
+		MaxErrors:     maxErrors,
+		RepoLimit:     repoLimit,
+		Mmap:          useMmap,
+		ZstdOptions:   zstdOpts,
+		SkipUnknown:   unknownFormat == unknownFormatSkip,
+		Decompress:    decompress,
+		CompressLevel: compressLevel,
+		Precompress:   precompress,
+		RenderText:    renderText,
+		Mandoc:        mandocPath,
+	}
+
+	// Find packages to extract again (if set)
+	if repair {
+		dumper.Repair = map[string]struct{}{}
+		for _, problem := range verifyTree(ctx, dumper.Cache, workers) {
+			logger.Info("Repairing file", logFile(problem.Path), zap.String("problem", problem.Problem))
+			for _, key := range problem.Keys {
+				dumper.Repair[key] = struct{}{}
+			}
+		}
 	}
 
 	filerefs := map[string]struct{}{}
@@ -158,16 +772,43 @@ func main() {
 		}
 	}
 
-	for _, file := range flag.Args() {
-		file := file
-		wg.Go(func() error {
-			return dumper.processRepoData(ctx, file)
-		})
+	var display *tui
+	if showTUI {
+		display = startTUI(os.Stderr, dumper.Status)
 	}
 
-	if err := wg.Wait(); err != nil {
+	if statusAddr != "" {
+		srv, err := startStatusServer(ctx, statusAddr, dumper.Status)
+		if err != nil {
+			logger.Fatal("Unable to start status server", zap.String("addr", statusAddr), zap.Error(err))
+		}
+		defer srv.Close()
+	}
+
+	// Each package uses two files -- one for the package, one for a new file -- so the number of
+	// packages processed at once is half the open file limit. For reproducible output, packages
+	// are processed one at a time so that conflicts between packages are always resolved the same
+	// way.
+	packageLimit := int(openLimit / 2)
+	if reproducible {
+		packageLimit = 1
+	}
+	notifier.requireProgress(true)
+	if rootfs != "" {
+		err = dumper.processRootfs(ctx, rootfs)
+	} else {
+		err = dumper.Run(ctx, args, packageLimit)
+	}
+	notifier.requireProgress(false)
+	if display != nil {
+		display.Stop()
+	}
+	if err != nil {
 		logger.Fatal("Fatal error processing files", zap.Error(err))
 	}
+	if fields := dumper.Timings.fields(slowest); fields != nil {
+		logger.Info("Package timings", fields...)
+	}
 
 	if memprofile != "" {
 		f, err := os.Create(memprofile)
@@ -181,6 +822,20 @@ func main() {
 		}
 	}
 
+	for _, prof := range []struct{ name, file string }{{"block", blockprofile}, {"mutex", mutexprofile}} {
+		if prof.file == "" {
+			continue
+		}
+		f, err := os.Create(prof.file)
+		if err != nil {
+			logger.Fatal("Failed to create profile file", zap.String("profile", prof.name), zap.Error(err))
+		}
+		defer f.Close()
+		if err := pprof.Lookup(prof.name).WriteTo(f, 0); err != nil {
+			logger.Fatal("Failed to write profile", zap.String("profile", prof.name), zap.Error(err))
+		}
+	}
+
 	// If we're not removing old files, just copy everything from the cache into updates.
 	if !removeOldFiles {
 		for k, files := range dumper.Cache {
@@ -199,24 +854,271 @@ func main() {
 		}
 	}
 
+	// Print the change plan and stop before anything is removed or written (if set)
+	if plan {
+		unused := make([]string, 0, len(filerefs))
+		for file := range filerefs {
+			unused = append(unused, file)
+		}
+		if err := newChangePlan(dumper.Written(), unused).write(os.Stdout); err != nil {
+			logger.Fatal("Error writing change plan", zap.Error(err))
+		}
+		return
+	}
+
 	// Remove old files
-	for file, _ := range filerefs {
-		if filepath.IsAbs(file) || strings.Contains(filepath.ToSlash(file), "../") {
+	cleanupStart := time.Now()
+	remover, err := openTreeRemover(".")
+	if err != nil {
+		logger.Fatal("Unable to open output directory", zap.Error(err))
+	}
+	unused := make([]string, 0, len(filerefs))
+	for file := range filerefs {
+		if !isRelativeTreePath(file) {
 			// This is to prevent removal of paths like /usr/share/man/... in case
 			// someone munges and then passes a .vmandump file in.
 			logger.Debug("Skipping removal of absolute file path", logFile(file))
 			continue
 		}
-		logger.Debug("Removing unused file", logFile(file))
-		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		unused = append(unused, file)
+	}
+	removed := make([]string, 0, len(unused))
+	remover.RemoveFiles(unused, int(workers), func(file string, err error) {
+		if err != nil && !os.IsNotExist(err) {
 			logger.Error("Error removing old file", logFile(file), zap.Error(err))
+			events.emit(event{Type: eventError, Path: file, Error: err.Error()})
+			return
+		}
+		logger.Debug("Removed unused file", logFile(file))
+		events.emit(event{Type: eventRemoved, Path: file})
+		removed = append(removed, file)
+	})
+
+	// Remove directories left empty by the removal of old files
+	for _, dir := range parentDirs(removed) {
+		err := remover.RemoveDir(dir)
+		if err == nil {
+			logger.Debug("Removed empty directory", logFile(dir))
+		} else if !os.IsNotExist(err) && !isDirNotEmpty(err) {
+			logger.Error("Error removing empty directory", logFile(dir), zap.Error(err))
+		}
+	}
+	remover.Close()
+
+	// Remove files no longer used from the dedup store (if set)
+	if dedupStore != "" {
+		n, err := sweepDedupStore(dedupStore)
+		if err != nil {
+			logger.Fatal("Error sweeping dedup store", logFile(dedupStore), zap.Error(err))
+		}
+		logger.Debug("Swept dedup store", logFile(dedupStore), zap.Int("removed", n))
+	}
+	dumper.Phases.add(phaseCleanup, time.Since(cleanupStart))
+	logger.Info("Phase timings", dumper.Phases.fields()...)
+
+	// Collect the files now in the output tree
+	treeSet := map[string]struct{}{}
+	for _, paths := range dumper.Updates {
+		for _, p := range paths {
+			treeSet[filepath.ToSlash(p)] = struct{}{}
+		}
+	}
+	treeFiles := sortedKeys(treeSet)
+	metadata.prune(treeSet)
+
+	// Write HTML indexes (if set)
+	var generated []string
+	if htmlIndex {
+		written, err := writeHTMLIndexes(treeFiles, metadata)
+		for _, file := range written {
+			dumper.recordWrite(filepath.FromSlash(file))
+		}
+		generated = append(generated, written...)
+		if err != nil {
+			logger.Fatal("Error writing HTML indexes", zap.Error(err))
+		}
+	}
+
+	// Write sitemap (if set)
+	if sitemap {
+		written, err := writeSitemap(baseURL, treeFiles)
+		for _, file := range written {
+			dumper.recordWrite(filepath.FromSlash(file))
+		}
+		generated = append(generated, written...)
+		if err != nil {
+			logger.Fatal("Error writing sitemap", zap.Error(err))
+		}
+	}
+
+	// Build apropos database (if set)
+	if whatisTool != "" {
+		db, err := buildWhatis(ctx, whatisTool)
+		if err != nil {
+			logger.Fatal("Error building apropos database", zap.String("tool", whatisTool), zap.Error(err))
+		}
+		dumper.recordWrite(db)
+		generated = append(generated, db)
+	}
+
+	// Remove generated files this run didn't write, such as indexes of sections that no longer exist
+	stale := map[string]struct{}{}
+	for _, file := range cache.Generated {
+		if _, ok := treeSet[file]; !ok && isRelativeTreePath(filepath.FromSlash(file)) {
+			stale[file] = struct{}{}
+		}
+	}
+	for _, file := range generated {
+		delete(stale, file)
+	}
+	if len(stale) > 0 {
+		remover, err := openTreeRemover(".")
+		if err != nil {
+			logger.Fatal("Unable to open output directory", zap.Error(err))
+		}
+		var staleRemoved []string
+		remover.RemoveFiles(sortedKeys(stale), int(workers), func(file string, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				logger.Error("Error removing old generated file", logFile(file), zap.Error(err))
+				events.emit(event{Type: eventError, Path: file, Error: err.Error()})
+				return
+			}
+			logger.Debug("Removed old generated file", logFile(file))
+			events.emit(event{Type: eventRemoved, Path: file})
+			staleRemoved = append(staleRemoved, filepath.FromSlash(file))
+		})
+		for _, dir := range parentDirs(staleRemoved) {
+			err := remover.RemoveDir(dir)
+			if err == nil {
+				logger.Debug("Removed empty directory", logFile(dir))
+			} else if !os.IsNotExist(err) && !isDirNotEmpty(err) {
+				logger.Error("Error removing empty directory", logFile(dir), zap.Error(err))
+			}
+		}
+		remover.Close()
+		removed = append(removed, staleRemoved...)
+	}
+
+	// Write rsync lists of changed files (if set)
+	if rsyncFilesFrom != "" {
+		if err := writeRsyncFilesFrom(rsyncFilesFrom, dumper.Written()); err != nil {
+			logger.Fatal("Error writing rsync files-from list", logFile(rsyncFilesFrom), zap.Error(err))
+		}
+	}
+	if rsyncFilter != "" {
+		if err := writeRsyncFilter(rsyncFilter, dumper.Written(), removed); err != nil {
+			logger.Fatal("Error writing rsync filter file", logFile(rsyncFilter), zap.Error(err))
+		}
+	}
+
+	// Write metadata index (if set)
+	if metadata != nil {
+		if err := metadata.write(metadataFile); err != nil {
+			logger.Fatal("Error writing metadata index", logFile(metadataFile), zap.Error(err))
+		}
+		if seeAlsoFile != "" {
+			if err := writeSeeAlsoGraph(seeAlsoFile, metadata.sorted()); err != nil {
+				logger.Fatal("Error writing SEE ALSO graph", logFile(seeAlsoFile), zap.Error(err))
+			}
+		}
+	}
+
+	// Report manpages provided by more than one package
+	conflicts := dumper.conflicts()
+	for _, c := range conflicts {
+		logger.Warn("Manpage provided by more than one package", logDumpFile(c.Path), zap.Strings("packages", c.Packages))
+	}
+	if conflictsFile != "" {
+		if err := writeConflicts(conflictsFile, conflicts); err != nil {
+			logger.Fatal("Error writing conflict report", logFile(conflictsFile), zap.Error(err))
+		}
+	}
+
+	// Write provenance (if set)
+	if provenanceFile != "" {
+		if err := dumper.writeProvenance(provenanceFile); err != nil {
+			logger.Fatal("Error writing provenance", logFile(provenanceFile), zap.Error(err))
+		}
+	}
+
+	// Write reverse index (if set)
+	if reverseIndex != "" {
+		if err := dumper.writeReverseIndex(reverseIndex); err != nil {
+			logger.Fatal("Error writing reverse index", logFile(reverseIndex), zap.Error(err))
+		}
+	}
+
+	// Write package manifest (if set)
+	if manifestFile != "" {
+		if err := dumper.writeManifest(manifestFile); err != nil {
+			logger.Fatal("Error writing package manifest", logFile(manifestFile), zap.Error(err))
+		}
+	}
+
+	// Export to PostgreSQL (if set)
+	if postgresDSN != "" {
+		if err := dumper.exportPostgres(ctx, psqlPath, postgresEnv, metadata); err != nil {
+			logger.Fatal("Error exporting to PostgreSQL", zap.Error(err))
+		}
+	}
+
+	// Sync search index (if set)
+	if search != nil {
+		if err := search.sync(ctx, dumper.Written(), removed, metadata); err != nil {
+			logger.Fatal("Error syncing search index", zap.Error(err))
+		}
+	}
+
+	// Publish output tree (if set)
+	if publishDir != "" {
+		files := append(append([]string(nil), treeFiles...), generated...)
+		if err := publishTree(ctx, publishDir, fileMode, files, removed); err != nil {
+			logger.Fatal("Error publishing output tree", zap.Error(err))
+		}
+	}
+
+	// Sync output tree to object storage (if set)
+	if bucket != nil {
+		if err := bucket.sync(ctx, dumper.Written(), removed); err != nil {
+			logger.Fatal("Error syncing output tree to object storage", zap.Error(err))
+		}
+	}
+
+	// Build squashfs image (if set)
+	if squashfsImage != "" {
+		files := append(append([]string(nil), treeFiles...), generated...)
+		if err := buildSquashfs(ctx, mksquashfsPath, squashfsImage, files, reproducible); err != nil {
+			logger.Fatal("Error building squashfs image", logFile(squashfsImage), zap.Error(err))
+		}
+	}
+
+	// Run sync command (if set). The cache is only written once it succeeds, so that a failed upload
+	// is retried by the next run.
+	if syncCommand != "" {
+		if err := runSyncCommand(ctx, syncCommand, rsyncFilesFrom, rsyncFilter); err != nil {
+			logger.Fatal("Error running sync command", zap.Error(err))
 		}
 	}
 
 	// Dump cache
+	if reproducible {
+		for _, paths := range dumper.Updates {
+			sort.Strings(paths)
+		}
+	}
+	// Repodata must be processed again, even if it doesn't change, if the run failed or skipped any
+	// packages or only covered some of them.
+	if dumper.Failed() > 0 || dumper.Skipped() > 0 || filter != nil || !cutoff.IsZero() {
+		repodata = nil
+	}
 	cache = cacheRecords{
 		Version: cacheVersion,
 		Cache:   dumper.Updates,
+		Repos:   dumper.packageRepos(cache.Repos),
+
+		Repodata:  repodata,
+		Options:   options,
+		Generated: generated,
 	}
 	p, err := json.Marshal(cache)
 	if err != nil {
@@ -227,15 +1129,29 @@ func main() {
 		if err := ioutil.WriteFile(cacheFile, p, 0600); err != nil {
 			logger.Fatal("Error writing cache", logFile(cacheFile), zap.Error(err))
 		}
+		if signKey != "" {
+			if err := signFile(ctx, signTool, signKey, cacheFile); err != nil {
+				logger.Fatal("Error signing cache", logFile(cacheFile), zap.Error(err))
+			}
+		}
 	} else {
 		_, _ = os.Stdout.Write(p)
 	}
+
+	notifier.Stop()
+
+	if n := dumper.Failed(); n > 0 {
+		logger.Fatal("Packages failed", zap.Int64("packages", n))
+	}
 }
 
 const (
 	manPathPrefix     = "usr/share/man/man"
 	manPathTrimPrefix = "usr/share/man/"
 	manDirsPrefix     = "/usr/share/man/man"
+
+	// noarch is the architecture of architecture-independent packages.
+	noarch = "noarch"
 )
 
 // TODO: Propagate list of created files up to caller so that they can be tracked relative as
@@ -244,58 +1160,379 @@ const (
 // Dumper processes packages and dumps manpage files to the current directory in the form manN/file.
 type Dumper struct {
 	DirMode os.FileMode
-	Sema    *semaphore.Weighted
+	// FileMode, if not zero, is the mode of written manpages. Otherwise, it is 0666 less the umask.
+	FileMode os.FileMode
+	Workers  *semaphore.Weighted // Decompression and parsing
 
+	// Compress, if true, writes all manpages gzipped with a .gz suffix. Manpages that are already
+	// compressed are recompressed so that the whole tree uses the same compression.
 	Compress bool
+	// CompressLevel is the gzip level used if Compress is set.
+	CompressLevel int
+
+	// Status, if not nil, tracks the progress of the Dumper.
+	Status *runStatus
+	// Events, if not nil, receives events as packages are processed.
+	Events *eventWriter
+	// Chaos, if not nil, injects failures for testing.
+	Chaos *chaos
+	// Timings, if not nil, records the time taken to extract each package.
+	Timings *packageTimings
+	// Phases, if not nil, records the time spent in each phase of the run.
+	Phases *phaseTimings
+	// KeepGoing, if true, continues past packages that fail instead of stopping the run. Failed
+	// packages aren't cached, so they're retried by the next run.
+	KeepGoing bool
+	// MaxErrors, if positive, stops a KeepGoing run once this many packages have failed.
+	MaxErrors int64
+	// WriteLimit, if not nil, limits the rate at which manpages are written.
+	WriteLimit *writeLimiter
+	// MinFree, if positive, is the number of bytes that must remain free in the output directory
+	// after extraction, as estimated from the installed sizes of packages before they're extracted.
+	MinFree int64
+	// Metadata, if not nil, receives the metadata of each manpage written.
+	Metadata *metadataIndex
+	// Reproducible, if true, sets the modification times of written files to their package's build
+	// date. Packages must also be processed in a stable order for the output to be reproducible.
+	Reproducible bool
+	// RepoNames maps repodata files to the names of their repositories. Files not listed use
+	// xrepo's default repository name.
+	RepoNames map[string]string
+	// SplitRepos, if true, writes each repository's manpages to a subdirectory named after the
+	// repository instead of merging them.
+	SplitRepos bool
+	// RepoPriority orders repositories from highest to lowest priority when merging them. A
+	// manpage provided by more than one repository is taken from the one with the highest
+	// priority. Repositories not listed have the lowest priority.
+	RepoPriority []string
+	// PackageDir, if set, is the directory package files are read from, such as an xbps cache
+	// directory. Otherwise, they are read from the directory of their repodata file. Package files
+	// whose size differs from their repodata entry are skipped.
+	PackageDir string
+	// SkipSuffixes lists package name suffixes of packages that are ignored entirely, such as -dbg.
+	SkipSuffixes []string
+	// Filter, if not nil, selects the packages to process by name.
+	Filter *packageFilter
+	// Since, if not zero, skips packages built before it. Their cached manpages are kept.
+	Since time.Time
+	// Force lists glob patterns of package names that are extracted even if they are in the cache.
+	Force []string
+	// Repair holds the cache keys of packages whose files are missing or damaged in the output
+	// tree. They are extracted again even though they are in the cache.
+	Repair map[string]struct{}
+	// Plan, if true, records the files that would be written for each manpage without writing them.
+	Plan bool
+	// Owner, if not nil, is the owner of files and directories created in the output tree.
+	Owner *fileOwner
+	// PreserveMtime, if true, sets the modification times of written files to those in the package
+	// archive.
+	PreserveMtime bool
+	// DedupStore, if set, is the directory of a content-addressed store. Written manpages with the
+	// same content are hard links to the same file in the store.
+	DedupStore string
+	// ShareDir, if set, is the root of another output tree. Written files identical to the file at
+	// the same path in ShareDir are replaced with links to it: hard links, or absolute symlinks if
+	// ShareSymlinks is true.
+	ShareDir      string
+	ShareSymlinks bool
+
+	// PlistMemLimit is the size above which files lists are buffered in a temporary file.
+	PlistMemLimit int64
+	// RepoLimit is the number of repodata files processed at once. If zero, all are.
+	RepoLimit int
+	// Mmap, if true, memory-maps package files instead of reading them.
+	Mmap bool
+	// ZstdOptions are passed to zstd decoders.
+	ZstdOptions []zstd.DOption
+	// SkipUnknown, if true, skips packages with unsupported compression formats instead of failing.
+	SkipUnknown bool
+	// Decompress, if true, writes compressed manpages decompressed and under their uncompressed
+	// names. Links to compressed manpages are renamed to match.
+	Decompress bool
+	// Precompress, if true, writes .gz and .br copies of each manpage alongside it. It cannot be
+	// used with Compress.
+	Precompress bool
+	// RenderText, if true, renders each manpage to a .txt file alongside it using the Mandoc
+	// command.
+	RenderText bool
+	Mandoc     string
 
 	m       sync.Mutex
 	Cache   map[string][]string
 	Updates map[string][]string
+	written []string
+
+	recorded map[string]map[string]struct{} // Paths in Updates, by package
+	packages map[string]*xrepo.Package      // Packages seen, by cache key
+	claims   map[string]pathClaim           // Claims on manpage paths, if merging by priority
+	noarch   map[string]struct{}            // noarch packages extracted, by cache key
+
+	failed  int64 // Packages failed in a KeepGoing run, accessed atomically
+	skipped int64 // Packages skipped because their files were missing or unusable, accessed atomically
+}
+
+// startNoarch records that the noarch package with the given cache key is being extracted. It
+// returns false if it already was during this run.
+func (d *Dumper) startNoarch(key string) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if _, ok := d.noarch[key]; ok {
+		return false
+	}
+	if d.noarch == nil {
+		d.noarch = map[string]struct{}{}
+	}
+	d.noarch[key] = struct{}{}
+	return true
+}
+
+// decompressPages returns whether compressed manpages are decompressed on extraction, either
+// because Decompress is set or because the pages are compressed again when written.
+func (d *Dumper) decompressPages() bool {
+	return d.Decompress || d.Compress || d.Precompress
 }
 
-func (d *Dumper) recordChange(pkg string, paths ...string) {
+// recordChange records paths as belonging to pkg. Paths already recorded for pkg are not recorded
+// again and are returned as duplicates.
+func (d *Dumper) recordChange(pkg string, paths ...string) (dups []string) {
 	d.m.Lock()
 	defer d.m.Unlock()
-	if len(paths) == 0 && len(d.Updates[pkg]) == 0 {
+
+	if d.recorded == nil {
+		d.recorded = map[string]map[string]struct{}{}
+	}
+	seen := d.recorded[pkg]
+	if seen == nil {
+		seen = map[string]struct{}{}
+		d.recorded[pkg] = seen
+	}
+
+	updates := d.Updates[pkg]
+	if updates == nil {
 		// This is a convenience for stripping two bytes per empty package off the cache JSON
-		d.Updates[pkg] = []string{}
-	} else {
-		d.Updates[pkg] = append(d.Updates[pkg], paths...)
+		updates = []string{}
 	}
+	for _, p := range paths {
+		if _, ok := seen[p]; ok {
+			dups = append(dups, p)
+			continue
+		}
+		seen[p] = struct{}{}
+		updates = append(updates, p)
+	}
+	d.Updates[pkg] = updates
+	return dups
 }
 
-func (d *Dumper) processRepoData(ctx context.Context, file string) (err error) {
-	rd, err := d.readRepoData(ctx, file)
-	if os.IsNotExist(err) {
-		return nil
+// dropChanges drops the paths recorded for the package with the given cache key, such as those
+// recorded before it failed. If the package was in the cache, its cached paths are recorded again.
+func (d *Dumper) dropChanges(key string) {
+	d.m.Lock()
+	delete(d.Updates, key)
+	delete(d.recorded, key)
+	entries, cached := d.Cache[key]
+	d.m.Unlock()
+	if cached {
+		d.recordChange(key, entries...)
+	}
+}
+
+// recordWrite records paths that were created or overwritten during this run.
+func (d *Dumper) recordWrite(paths ...string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.written = append(d.written, paths...)
+}
+
+// Written returns the paths created or overwritten during this run.
+func (d *Dumper) Written() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]string(nil), d.written...)
+}
+
+// packageJob is a package queued for processing.
+type packageJob struct {
+	repodata string
+	pkg      *xrepo.Package
+	file     string
+}
+
+// Run processes all packages in the given repodata files. Packages are queued to a fixed pool of
+// workers goroutines, so the number of packages open at once (and the memory held for them) stays
+// bounded regardless of repository size.
+func (d *Dumper) Run(ctx context.Context, files []string, workers int) error {
+	if workers < 1 {
+		workers = 1
 	}
 
 	wg, ctx := errgroup.WithContext(ctx)
-	dir := filepath.Dir(file)
-	index := rd.Index()
-	for _, pkg := range index {
-		pkg := pkg
-		pkgfile := filepath.Join(dir, pkg.PackageVersion+"."+pkg.Architecture+".xbps")
+	jobs := make(chan packageJob, workers)
 
-		if err := d.Sema.Acquire(ctx, 2); err != nil {
-			return err
+	for i := 0; i < workers; i++ {
+		wg.Go(func() error {
+			for job := range jobs {
+				if err := d.processJob(ctx, job); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	wg.Go(func() error {
+		defer close(jobs)
+		return d.schedule(ctx, files, jobs)
+	})
+
+	return wg.Wait()
+}
+
+// queuedRepo is a repodata file whose packages are being queued.
+type queuedRepo struct {
+	file string
+	dir  string
+	pkgs xrepo.Packages
+}
+
+// schedule reads repodata files and queues their packages round-robin, so that packages from all
+// active repodata files are processed fairly. At most RepoLimit repodata files are active at once
+// (or all of them, if RepoLimit is zero); the next file is read once an active one is exhausted.
+// It blocks while the queue is full.
+func (d *Dumper) schedule(ctx context.Context, files []string, jobs chan<- packageJob) error {
+	limit := d.RepoLimit
+	if limit <= 0 || limit > len(files) {
+		limit = len(files)
+	}
+
+	pending := files
+	var active []*queuedRepo
+	for {
+		if n := limit - len(active); n > 0 && len(pending) > 0 {
+			if n > len(pending) {
+				n = len(pending)
+			}
+			repos, err := d.loadRepos(ctx, pending[:n])
+			if err != nil {
+				return err
+			}
+			// Check for enough free space before extracting these packages, rather than running out
+			// halfway.
+			if err := d.checkSpace(ctx, repos); err != nil {
+				return err
+			}
+			pending = pending[n:]
+			active = append(active, repos...)
+			continue
+		}
+
+		if len(active) == 0 {
+			return nil
 		}
 
+		next := active[:0]
+		for _, repo := range active {
+			pkg := repo.pkgs[0]
+			repo.pkgs = repo.pkgs[1:]
+			job := packageJob{
+				repodata: repo.file,
+				pkg:      pkg,
+				file:     filepath.Join(repo.dir, pkg.PackageVersion+"."+pkg.Architecture+".xbps"),
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if len(repo.pkgs) > 0 {
+				next = append(next, repo)
+			}
+		}
+		active = next
+	}
+}
+
+// loadRepos concurrently reads the given repodata files and returns those that have packages.
+// Missing repodata files are skipped.
+func (d *Dumper) loadRepos(ctx context.Context, files []string) ([]*queuedRepo, error) {
+	repos := make([]*queuedRepo, len(files))
+	var wg errgroup.Group
+	for i, file := range files {
+		i, file := i, file
 		wg.Go(func() error {
-			defer d.Sema.Release(2)
-			return d.processPackage(ctx, pkg, pkgfile)
+			rd, err := d.readRepoData(ctx, file)
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			index := rd.Index()
+			d.Status.addRepo(file, len(index))
+			dir := filepath.Dir(file)
+			if d.PackageDir != "" {
+				dir = d.PackageDir
+			}
+			repos[i] = &queuedRepo{file: file, dir: dir, pkgs: index}
+			return nil
 		})
 	}
+	if err := wg.Wait(); err != nil {
+		return nil, err
+	}
 
-	return wg.Wait()
+	loaded := repos[:0]
+	for _, repo := range repos {
+		if repo != nil && len(repo.pkgs) > 0 {
+			loaded = append(loaded, repo)
+		}
+	}
+	return loaded, nil
+}
+
+// processJob processes a single queued package.
+func (d *Dumper) processJob(ctx context.Context, job packageJob) error {
+	ev := event{Repodata: job.repodata, Package: job.pkg.PackageVersion, File: job.file}
+	d.Events.emit(withEventType(ev, eventPackageStarted))
+	err := d.processPackage(ctx, job.pkg, job.file)
+	d.Status.packageDone(job.repodata, job.file, err)
+	if err != nil {
+		ev.Error = err.Error()
+		d.Events.emit(withEventType(ev, eventError))
+	}
+	d.Events.emit(withEventType(ev, eventPackageFinished))
+	if err != nil && d.KeepGoing {
+		// Whatever the package got through before failing isn't cached, so that it's retried.
+		d.dropChanges(d.cacheKey(job.pkg))
+		n := atomic.AddInt64(&d.failed, 1)
+		if d.MaxErrors > 0 && n >= d.MaxErrors {
+			return fmt.Errorf("too many failed packages (%d)", n)
+		}
+		return nil
+	}
+	return err
+}
+
+// Failed returns the number of packages that failed in a KeepGoing run.
+func (d *Dumper) Failed() int64 {
+	return atomic.LoadInt64(&d.failed)
+}
+
+// Skipped returns the number of packages skipped because their files were missing or unusable.
+// These aren't cached, so they're picked up by a later run.
+func (d *Dumper) Skipped() int64 {
+	return atomic.LoadInt64(&d.skipped)
 }
 
 func (d *Dumper) readRepoData(ctx context.Context, file string) (*xrepo.RepoData, error) {
 	ctx = WithFields(ctx, logRepoData(file))
 
-	timer := Elapsed("elapsed")
 	Info(ctx, "Processing repodata")
-	defer func() { Info(ctx, "Finished processing repodata", timer()) }()
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		d.Phases.add(phaseRepodata, elapsed)
+		Info(ctx, "Finished processing repodata", zap.Duration("elapsed", elapsed))
+	}()
 
 	f, err := os.Open(file)
 	if os.IsNotExist(err) {
@@ -308,7 +1545,7 @@ func (d *Dumper) readRepoData(ctx context.Context, file string) (*xrepo.RepoData
 	defer logClose(ctx, f)
 
 	rd := xrepo.NewRepoData()
-	if err := rd.ReadRepo(f, ""); err != nil {
+	if err := rd.ReadRepo(f, d.RepoNames[file]); err != nil {
 		Error(ctx, "Unable to read repodata", zap.Error(err))
 		return nil, err
 	}
@@ -320,115 +1557,177 @@ func (d *Dumper) readRepoData(ctx context.Context, file string) (*xrepo.RepoData
 func (d *Dumper) processPackage(ctx context.Context, pkg *xrepo.Package, file string) (err error) {
 	ctx = WithFields(ctx, logFile(file))
 
-	if strings.HasSuffix(pkg.Name, "-dbg") || strings.HasSuffix(pkg.Name, "-32bit") {
-		// Skip 32-bit and -dbg packages
-		Debug(ctx, "Ignored debug/32-bit package")
+	if suffix := matchSuffix(d.SkipSuffixes, pkg.Name); suffix != "" {
+		// Skip 32-bit and -dbg packages, by default
+		Debug(ctx, "Ignored package by suffix", zap.String("suffix", suffix))
 		return nil
 	}
 
-	if entries, ok := d.Cache[pkg.FilenameSHA256]; ok {
-		Debug(ctx, "Package already dumped")
-		d.recordChange(pkg.FilenameSHA256, entries...)
+	d.recordPackage(pkg)
+	key := d.cacheKey(pkg)
+
+	if !d.Filter.match(pkg.Name) {
+		// Keep what was previously dumped for filtered packages so that running over a subset of
+		// packages doesn't remove the rest.
+		Debug(ctx, "Package excluded by filter")
+		if entries, ok := d.Cache[key]; ok {
+			d.recordChange(key, entries...)
+		}
+		return nil
+	}
+
+	if !d.Since.IsZero() && pkg.BuildDate.Time().Before(d.Since) {
+		Debug(ctx, "Package built before cutoff", zap.Time("build_date", pkg.BuildDate.Time()))
+		if entries, ok := d.Cache[key]; ok {
+			d.recordChange(key, entries...)
+		}
+		return nil
+	}
+
+	cacheStart := time.Now()
+	_, repair := d.Repair[key]
+	if entries, ok := d.Cache[key]; ok && matchAny(d.Force, pkg.Name) {
+		Debug(ctx, "Package already dumped, but forced to extract again")
+	} else if ok && repair {
+		Info(ctx, "Package files are missing or damaged, extracting again")
+	} else if ok {
+		if d.claimCached(pkg.Repository, entries) {
+			Debug(ctx, "Package already dumped")
+			d.recordChange(key, entries...)
+			d.Phases.add(phaseCache, time.Since(cacheStart))
+			return nil
+		}
+		Info(ctx, "Package manpages were replaced by a lower-priority repository, extracting again")
+	}
+
+	if pkg.Architecture == noarch && !d.startNoarch(key) {
+		// noarch packages are listed in the repodata of every architecture, but they're the same
+		// file and share a cache entry, so only the first is extracted.
+		Debug(ctx, "Package already extracted for another architecture")
 		return nil
 	}
 
 	Info(ctx, "Processing file")
-	timer := Elapsed("elapsed")
-	defer func() { Info(ctx, "Finished processing file", timer()) }()
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		d.Timings.record(pkg.PackageVersion, elapsed)
+		Info(ctx, "Finished processing file", zap.Duration("elapsed", elapsed))
+	}()
+
+	if err := d.Chaos.failPackage(); err != nil {
+		Error(ctx, "Injected package failure", zap.Error(err))
+		return err
+	}
 
 	f, err := os.Open(file)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && d.PackageDir != "" {
+		// Package directories are expected to hold only some packages.
+		Debug(ctx, "Package not in package directory")
+		atomic.AddInt64(&d.skipped, 1)
+		return nil
+	} else if os.IsNotExist(err) {
 		Warn(ctx, "File does not exist")
+		atomic.AddInt64(&d.skipped, 1)
 		return nil
 	} else if err != nil {
 		Error(ctx, "Cannot open file", zap.Error(err))
 		return err
 	}
 
-	mime, err := mimetype.DetectFile(file)
-	if err != nil {
-		Error(ctx, "Cannot detect file type", zap.Error(err))
-	}
-
-	var dec io.ReadCloser
-	err = nil
-	switch {
-	case mime.Is("application/x-xz"):
-		var xzDec *xz.Reader
-		xzDec, err = xz.NewReader(f)
-		dec = io.NopCloser(xzDec)
-	case mime.Is("application/zstd"):
-		var zstdDec *zstd.Decoder
-		zstdDec, err = zstd.NewReader(f)
-		dec = zstdDec.IOReadCloser()
-	default:
-		err = fmt.Errorf("Compression format for %s is not supported", file)
+	defer f.Close()
+
+	if d.PackageDir != "" && pkg.FilenameSize > 0 {
+		// Cache directories may hold packages built for other repositories.
+		if fi, err := f.Stat(); err == nil && fi.Size() != pkg.FilenameSize {
+			Warn(ctx, "Skipping package file that does not match repodata", zap.Int64("size", fi.Size()), zap.Int64("expected_size", pkg.FilenameSize))
+			atomic.AddInt64(&d.skipped, 1)
+			return nil
+		}
 	}
 
-	if err != nil {
-		Error(ctx, "Unable to create decompressor", zap.Error(err))
+	// Open files are limited by the worker pool -- decompression and parsing are limited separately so that IO
+	// and CPU concurrency can be tuned independently.
+	if err := d.Workers.Acquire(ctx, 1); err != nil {
 		return err
 	}
+	defer d.Workers.Release(1)
 
-	defer dec.Close()
-	tf := tar.NewReader(dec)
+	format, err := detectFormat(file)
+	if _, ok := err.(*unsupportedFormatError); ok && d.SkipUnknown {
+		Warn(ctx, "Skipping package with unsupported compression format", zap.Error(err))
+		atomic.AddInt64(&d.skipped, 1)
+		return nil
+	} else if err != nil {
+		Error(ctx, "Unable to detect compression format", zap.Error(err))
+		return err
+	}
 
-	var manpages map[string]struct{}
-	var files packageFiles
-	for {
-		hdr, err := tf.Next()
-		if err == io.EOF {
-			goto done
-		} else if err != nil {
-			Error(ctx, "Error encountered reading package", zap.Error(err))
+	var pkgReader io.ReadSeeker = f
+	if d.Mmap {
+		data, unmap, err := mmapFile(f)
+		if err != nil {
+			Error(ctx, "Unable to map file", zap.Error(err))
 			return err
 		}
+		defer unmap()
+		pkgReader = bytes.NewReader(data)
+	}
 
-		if hdr.Typeflag != tar.TypeReg {
-			continue
+	// openTar (re)opens the package's tar stream from the start.
+	var (
+		decoders       []io.Closer
+		decompressTime time.Duration
+	)
+	defer func() { d.Phases.add(phaseDecompress, decompressTime) }()
+	defer func() {
+		for _, dec := range decoders {
+			dec.Close()
 		}
-
-		pkgfile := path.Clean(hdr.Name)
-		if pkgfile != "files.plist" {
-			continue
+	}()
+	openTar := func() (*tar.Reader, error) {
+		if _, err := pkgReader.Seek(0, io.SeekStart); err != nil {
+			return nil, err
 		}
-
-		buffer, err := copyToMemory(tf)
+		dec, err := newDecompressor(format, d.Chaos.reader(d.Status.countReader(pkgReader)), d.ZstdOptions...)
 		if err != nil {
-			Error(ctx, "Error reading files list", zap.Error(err))
-			return err
+			return nil, err
 		}
-
-		if err := plist.NewDecoder(buffer).Decode(&files); err != nil {
-			Error(ctx, "Error decoding files list", zap.Error(err))
-			return err
-		}
-
-		break
-	}
-
-	if files.Empty() {
-		goto done
+		decoders = append(decoders, dec)
+		return tar.NewReader(&timedReader{r: dec, elapsed: &decompressTime}), nil
 	}
 
-	for _, dir := range files.Dirs {
-		p := path.Clean(dir.File)
-		if strings.HasPrefix(p, manDirsPrefix) {
-			goto scanPackage
-		}
+	tf, err := openTar()
+	if err != nil {
+		Error(ctx, "Unable to create decompressor", zap.Error(err))
+		return err
 	}
-	goto done
 
-scanPackage:
-	manpages = map[string]struct{}{}
-	for _, file := range append(files.Files, files.Links...) {
-		if strings.HasPrefix(file.File, manDirsPrefix) {
-			pkgfile := "." + file.File
-			manpages[pkgfile] = struct{}{}
+	// If the files list is missing or can't be decoded, fall back to scanning the whole archive
+	// for manpages rather than skipping the package.
+	scanAll := false
+	plistStart, plistDecompress := time.Now(), decompressTime
+	files, found, err := readFilesList(tf, d.PlistMemLimit)
+	// Decompression while reading the files list is counted separately.
+	d.Phases.add(phasePlist, time.Since(plistStart)-(decompressTime-plistDecompress))
+	if _, ok := err.(*filesListError); ok {
+		Warn(ctx, "Invalid files list, scanning whole package", zap.Error(err))
+		scanAll = true
+	} else if err != nil {
+		Error(ctx, "Error reading files list", zap.Error(err))
+		return err
+	} else if !found {
+		Warn(ctx, "Package has no files list, scanning whole package")
+		scanAll = true
+		if tf, err = openTar(); err != nil {
+			Error(ctx, "Unable to create decompressor", zap.Error(err))
+			return err
 		}
 	}
 
-	for len(manpages) > 0 {
+	manpages := files.manpages()
+	seen := map[string]struct{}{}
+	for scanAll || len(manpages) > 0 {
 		hdr, err := tf.Next()
 		if err == io.EOF {
 			break
@@ -437,34 +1736,55 @@ scanPackage:
 			return err
 		}
 
-		err = d.processPackageFile(ctx, pkg, hdr, tf)
+		if isArchiveMetadata(hdr) {
+			Debug(ctx, "Skipping archive metadata entry", logPkgFile(hdr.Name))
+			continue
+		}
+
+		err = d.processPackageFile(ctx, pkg, hdr, tf, seen)
 		if err != nil {
 			Error(ctx, "Error processing package file", logPkgFile(hdr.Name), zap.Error(err))
 			return err
 		}
 
-		delete(manpages, hdr.Name)
+		delete(manpages, manpageKey(hdr.Name))
 	}
 
-done:
-	d.recordChange(pkg.FilenameSHA256)
+	// Anything left was listed in files.plist but never found in the archive.
+	if len(manpages) > 0 {
+		missing := sortedKeys(manpages)
+		Warn(ctx, "Manpages listed in files list not found in package", zap.Strings("missing", missing))
+		d.Events.emit(event{Type: eventPagesMissing, Package: pkg.PackageVersion, File: file, Paths: missing})
+	}
 
-	f.Close()
+	// Manpage links registered through alternatives groups are created by XBPS rather than shipped
+	// in the archive.
+	for _, hdr := range alternativeManpages(pkg) {
+		if err := d.processPackageFile(ctx, pkg, hdr, nil, seen); err != nil {
+			Error(ctx, "Error processing alternatives link", logPkgFile(hdr.Name), zap.Error(err))
+			return err
+		}
+	}
+
+	d.recordChange(d.cacheKey(pkg))
 	return nil
 }
 
 // processPackageFile checks the tar header to see if the packaged file is a manpage and, if it is,
 // extracts it. If the packaged file is a manpage symlink, create that link.
-func (d *Dumper) processPackageFile(ctx context.Context, pkg *xrepo.Package, hdr *tar.Header, r io.Reader) (err error) {
+//
+// seen holds the paths already extracted from the package. If a package contains the same path
+// more than once, the last entry read wins.
+func (d *Dumper) processPackageFile(ctx context.Context, pkg *xrepo.Package, hdr *tar.Header, r io.Reader, seen map[string]struct{}) (err error) {
 	ctx = WithFields(ctx, logPkgFile(hdr.Name))
-	symlink := false
 
 	switch hdr.Typeflag {
 	case tar.TypeReg:
 		Debug(ctx, "Found manpage")
 	case tar.TypeSymlink:
 		Debug(ctx, "Found symlink")
-		symlink = true
+	case tar.TypeLink:
+		Debug(ctx, "Found hard link")
 	default:
 		return nil
 	}
@@ -474,88 +1794,277 @@ func (d *Dumper) processPackageFile(ctx context.Context, pkg *xrepo.Package, hdr
 		return nil
 	}
 
+	if err := checkPackagePath(hdr.Name); err != nil {
+		Warn(ctx, "Skipping manpage with unsafe path", zap.Error(err))
+		return nil
+	}
+
 	relpath := strings.TrimPrefix(pkgfile, manPathTrimPrefix)
-	relpath = filepath.FromSlash(relpath)
+	relpath = filepath.Join(d.repoDir(pkg), filepath.FromSlash(relpath))
 	reldir := filepath.Dir(relpath)
 
 	ctx = WithFields(ctx, logDumpFile(relpath))
 
+	if err := checkTreePath(relpath); err != nil {
+		Warn(ctx, "Skipping manpage with unsafe path", zap.Error(err))
+		return nil
+	}
+
+	var pageSuffix string
+	if d.decompressPages() {
+		pageSuffix = pageCompression(relpath)
+		relpath = strings.TrimSuffix(relpath, pageSuffix)
+	}
+
+	if _, ok := seen[relpath]; ok {
+		Warn(ctx, "Package contains duplicate manpage entry, replacing earlier entry")
+	}
+	seen[relpath] = struct{}{}
+
+	if !d.claimPath(pkg.Repository, relpath) {
+		Debug(ctx, "Skipping manpage provided by a higher-priority repository")
+		return nil
+	}
+
+	var lname string
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		lname, err = resolveLinkname(pkgfile, hdr.Linkname)
+		if err != nil {
+			Warn(ctx, "Skipping manpage symlink with unsafe target", zap.String("linkname", hdr.Linkname), zap.Error(err))
+			return nil
+		}
+	case tar.TypeLink:
+		// Hard links refer to an earlier entry in the archive, which must be an already-extracted
+		// manpage.
+		lname, err = resolveHardLink(hdr.Linkname)
+		if err != nil {
+			Warn(ctx, "Skipping hard link to non-manpage", zap.String("linkname", hdr.Linkname), zap.Error(err))
+			return nil
+		}
+		lname = filepath.Join(d.repoDir(pkg), lname)
+	}
+
+	if d.decompressPages() {
+		if hdr.Typeflag == tar.TypeReg {
+			dec, err := newPageDecompressor(pageSuffix, r)
+			if err != nil {
+				Warn(ctx, "Skipping manpage that cannot be decompressed", zap.Error(err))
+				return nil
+			}
+			defer logClose(ctx, dec)
+			r = dec
+		} else {
+			lname = trimPageCompression(lname)
+		}
+	}
+
+	if d.Plan {
+		d.planPage(pkg, relpath)
+		return nil
+	}
+
+	if err = checkNoSymlinkDirs(reldir); err != nil {
+		Error(ctx, "Refusing to write manpage beneath symlinked directory", zap.Error(err))
+		return err
+	}
+
 	if err = os.MkdirAll(reldir, d.DirMode); err != nil {
 		Error(ctx, "Unable to create directory for manpage", zap.Error(err))
 		return err
 	}
+	if err = d.Owner.chownDirs(reldir); err != nil {
+		Error(ctx, "Unable to set owner of directory for manpage", zap.Error(err))
+		return err
+	}
 
 	if d.Compress {
 		relpath += ".gz"
 	}
 
 	// check if a file already exists and remove it
-	if _, err := os.Lstat(relpath); err == nil {
-		if err := os.Remove(relpath); err != nil {
-			Error(ctx, "Unable to remove existing file")
-			return err
-		}
+	if err := removeExisting(relpath); err != nil {
+		Error(ctx, "Unable to remove existing file")
+		return err
 	}
 
-	if !symlink {
-		// TODO: Dump manpage to filesystem after stripping usr/share/ prefix
-		f, err := os.Create(relpath)
+	paths := []string{relpath}
+	pages := 1 // Number of paths that are the manpage or its copies, not renditions of it
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		siblings, err := d.writePage(ctx, relpath, r)
+		paths = append(paths, siblings...)
 		if err != nil {
-			Error(ctx, "Unable to create dumped file")
 			return err
 		}
-		w := io.WriteCloser(f)
-		defer logClose(ctx, w)
+	case tar.TypeSymlink:
 		if d.Compress {
-			w = gzip.NewWriter(w)
-			defer logClose(ctx, w)
+			lname += ".gz"
 		}
-
-		if _, err := io.Copy(w, r); err != nil {
-			Error(ctx, "Error copying pkgfile to dumpfile", zap.Error(err))
+		if err := os.Symlink(lname, relpath); err != nil {
+			Error(ctx, "Unable to create symlink")
 			return err
 		}
-	} else {
-		lname := hdr.Linkname
+		if d.Precompress {
+			links, err := linkPrecompressed(lname, relpath, os.Symlink)
+			paths = append(paths, links...)
+			if err != nil {
+				Error(ctx, "Unable to create precompressed symlink", zap.Error(err))
+				return err
+			}
+		}
+	case tar.TypeLink:
 		if d.Compress {
 			lname += ".gz"
 		}
-		if err := os.Symlink(lname, relpath); err != nil {
-			Error(ctx, "Unable to create symlink")
+		err := os.Link(lname, relpath)
+		if os.IsNotExist(err) {
+			Warn(ctx, "Skipping hard link to manpage that was not extracted", zap.String("linkname", hdr.Linkname))
+			return nil
+		} else if err != nil {
+			Error(ctx, "Unable to create hard link", zap.Error(err))
 			return err
 		}
+		if d.Precompress {
+			links, err := linkPrecompressed(lname, relpath, os.Link)
+			paths = append(paths, links...)
+			if err != nil {
+				Error(ctx, "Unable to create precompressed hard link", zap.Error(err))
+				return err
+			}
+		}
 	}
 
-	d.recordChange(pkg.FilenameSHA256, relpath)
+	pages = len(paths)
+
+	if d.RenderText {
+		txt, err := d.renderText(ctx, hdr.Typeflag, relpath, lname)
+		if txt != "" {
+			paths = append(paths, txt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.FileMode != 0 && hdr.Typeflag == tar.TypeReg {
+		for _, p := range paths {
+			if err := os.Chmod(p, d.FileMode); err != nil {
+				Error(ctx, "Unable to set mode of dumped file", logDumpFile(p), zap.Error(err))
+				return err
+			}
+		}
+	}
+
+	if err := d.Owner.chown(paths...); err != nil {
+		Error(ctx, "Unable to set owner of dumped file", zap.Error(err))
+		return err
+	}
+
+	if mtime, ok := d.fileMtime(pkg, hdr); ok {
+		for _, p := range paths {
+			if err := lchtimes(p, mtime); err != nil {
+				Error(ctx, "Unable to set modification time", logDumpFile(p), zap.Error(err))
+				return err
+			}
+		}
+	}
+
+	// Deduplicate only once the page's attributes are final, since they're shared by its links.
+	if d.DedupStore != "" && hdr.Typeflag == tar.TypeReg {
+		for _, p := range paths[:pages] {
+			if err := dedupFile(ctx, d.DedupStore, p); err != nil {
+				Error(ctx, "Unable to deduplicate manpage", logDumpFile(p), zap.Error(err))
+				return err
+			}
+		}
+	}
+
+	if d.ShareDir != "" {
+		for _, p := range paths {
+			if _, err := shareFile(ctx, d.ShareDir, p, d.ShareSymlinks); err != nil {
+				Error(ctx, "Unable to share manpage with other tree", logDumpFile(p), zap.Error(err))
+				return err
+			}
+		}
+	}
+
+	if d.Metadata != nil {
+		d.Metadata.set(d.pageMeta(ctx, pkg, hdr.Typeflag, relpath, lname))
+	}
+
+	d.recordChange(d.cacheKey(pkg), paths...)
+	d.recordWrite(paths...)
+	d.Status.pageWritten()
+	d.Events.emit(event{Type: eventPageWritten, Package: pkg.PackageVersion, Path: relpath})
 
 	return nil
 }
 
-func logClose(ctx context.Context, c io.Closer) (err error) {
-	if err = c.Close(); err != nil {
-		Warn(ctx, "Encountered Close error", zap.Error(err))
+// fileMtime returns the modification time to set on files written for hdr from pkg, if any. Entries
+// without a modification time, such as alternatives links, use the package's build date.
+func (d *Dumper) fileMtime(pkg *xrepo.Package, hdr *tar.Header) (time.Time, bool) {
+	if d.PreserveMtime && !hdr.ModTime.IsZero() {
+		return hdr.ModTime, true
 	}
-	return err
+	if d.PreserveMtime || d.Reproducible {
+		return pkg.BuildDate.Time(), true
+	}
+	return time.Time{}, false
 }
 
-type packageFiles struct {
-	Files []packageFile `plist:"files"`
-	Dirs  []packageFile `plist:"dirs"`
-	Links []packageFile `plist:"links"`
-}
+// writePage writes the manpage read from r to relpath, compressing it if Compress is set. If
+// Precompress is set, it also writes compressed copies of the page and returns their paths.
+func (d *Dumper) writePage(ctx context.Context, relpath string, r io.Reader) (siblings []string, err error) {
+	// Time spent reading r is counted by the package's decompression, not the write.
+	var readTime time.Duration
+	r = &timedReader{r: r, elapsed: &readTime}
+	start := time.Now()
+	defer func() { d.Phases.add(phaseWrite, time.Since(start)-readTime) }()
 
-func (p *packageFiles) Empty() bool {
-	return len(p.Dirs) == 0
-}
+	f, err := createNoFollow(relpath, 0666)
+	if err != nil {
+		Error(ctx, "Unable to create dumped file")
+		return siblings, err
+	}
+	w := io.WriteCloser(f)
+	defer logClose(ctx, w)
+	if d.Compress {
+		gw, err := gzip.NewWriterLevel(w, d.CompressLevel)
+		if err != nil {
+			Error(ctx, "Unable to create gzip writer", zap.Error(err))
+			return siblings, err
+		}
+		defer logClose(ctx, gw)
+		w = gw
+	}
+
+	dst := io.Writer(w)
+	if d.Precompress {
+		dsts := []io.Writer{w}
+		for _, suffix := range precompressSuffixes {
+			pw, err := createPrecompressed(relpath, suffix)
+			if err != nil {
+				Error(ctx, "Unable to create precompressed file", zap.Error(err))
+				return siblings, err
+			}
+			defer logClose(ctx, pw)
+			dsts = append(dsts, pw)
+			siblings = append(siblings, relpath+suffix)
+		}
+		dst = io.MultiWriter(dsts...)
+	}
 
-type packageFile struct {
-	File string `plist:"file"`
+	if _, err := copyBuffer(d.WriteLimit.writer(d.Chaos.writer(dst)), r); err != nil {
+		Error(ctx, "Error copying pkgfile to dumpfile", zap.Error(err))
+		return siblings, err
+	}
+	return siblings, nil
 }
 
-func copyToMemory(r io.Reader) (*bytes.Reader, error) {
-	p, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
+func logClose(ctx context.Context, c io.Closer) (err error) {
+	if err = c.Close(); err != nil {
+		Warn(ctx, "Encountered Close error", zap.Error(err))
 	}
-	return bytes.NewReader(p), nil
+	return err
 }
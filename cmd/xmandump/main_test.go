@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+	"golang.org/x/sync/semaphore"
+)
+
+// writeTestPackage writes an uncompressed package archive of entries to file.
+func writeTestPackage(t *testing.T, file string, entries []testTarEntry) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.body))
+		hdr.Mode = 0644
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepGoingFailedPackageNotCached(t *testing.T) {
+	const key = "0123abcd"
+	cases := []struct {
+		name   string
+		cache  map[string][]string
+		want   []string
+		cached bool
+	}{
+		{"new package", map[string][]string{}, nil, false},
+		{"cached package extracted again", map[string][]string{key: {"man1/old.1"}}, []string{"man1/old.1"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "xmandump-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			// The first page fits within the injected ENOSPC limit and the second doesn't, so the
+			// package fails after one of its pages is recorded.
+			file := "foo-1.0_1.x86_64.xbps"
+			writeTestPackage(t, file, []testTarEntry{
+				{tar.Header{Typeflag: tar.TypeReg, Name: "./usr/share/man/man1/a.1"}, ".TH A 1\n"},
+				{tar.Header{Typeflag: tar.TypeReg, Name: "./usr/share/man/man1/b.1"}, ".TH B 1\nmore than eight bytes\n"},
+			})
+			d := &Dumper{
+				DirMode:   0755,
+				Workers:   semaphore.NewWeighted(1),
+				Chaos:     newChaos(0, 0, 8, 1),
+				KeepGoing: true,
+				Cache:     c.cache,
+				Updates:   map[string][]string{},
+				Force:     []string{"*"},
+			}
+			pkg := &xrepo.Package{Name: "foo", PackageVersion: "foo-1.0_1", Architecture: "x86_64", FilenameSHA256: key}
+			if err := d.processJob(context.Background(), packageJob{pkg: pkg, file: file}); err != nil {
+				t.Fatalf("processJob: %v", err)
+			}
+			if d.Failed() != 1 {
+				t.Fatalf("Failed() = %d; want 1", d.Failed())
+			}
+			if _, err := os.Stat("man1/a.1"); err != nil {
+				t.Fatalf("first page was not written before the failure: %v", err)
+			}
+			got, ok := d.Updates[key]
+			if ok != c.cached || !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Updates[%q] = %q, %v; want %q, %v", key, got, ok, c.want, c.cached)
+			}
+		})
+	}
+}
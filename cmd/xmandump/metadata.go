@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+
+	"go.uber.org/zap"
+)
+
+// maxPageParseSize is the number of bytes of a manpage read when parsing its metadata.
+const maxPageParseSize = 4 << 20
+
+// pageMeta describes a single manpage in the metadata index.
+type pageMeta struct {
+	Path        string   `json:"path"`
+	Package     string   `json:"package,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Section     string   `json:"section,omitempty"`
+	Names       []string `json:"names,omitempty"`
+	Description string   `json:"description,omitempty"`
+	// SeeAlso lists the manpages referred to by the SEE ALSO section, e.g. "foo(1)".
+	SeeAlso []string `json:"see_also,omitempty"`
+	// Link is the path of the manpage this one links to, if it is a symlink or hard link.
+	Link string `json:"link,omitempty"`
+}
+
+// metadataIndex is a JSON index of manpage metadata, keyed by output path. It is loaded at the start
+// of a run so that pages extracted by earlier runs remain in the index.
+type metadataIndex struct {
+	m     sync.Mutex
+	pages map[string]*pageMeta
+}
+
+// loadMetadataIndex reads the metadata index from file. If file does not exist, an empty index is
+// returned.
+func loadMetadataIndex(file string) (*metadataIndex, error) {
+	idx := &metadataIndex{pages: map[string]*pageMeta{}}
+	p, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var pages []*pageMeta
+	if err := json.Unmarshal(p, &pages); err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		idx.pages[page.Path] = page
+	}
+	return idx, nil
+}
+
+// set adds or replaces the metadata of a manpage.
+func (idx *metadataIndex) set(meta *pageMeta) {
+	if idx == nil {
+		return
+	}
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	idx.pages[meta.Path] = meta
+}
+
+// get returns the metadata of the manpage at path p, or nil if there is none.
+func (idx *metadataIndex) get(p string) *pageMeta {
+	if idx == nil {
+		return nil
+	}
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	return idx.pages[p]
+}
+
+// prune drops pages whose paths are not in keep from the index.
+func (idx *metadataIndex) prune(keep map[string]struct{}) {
+	if idx == nil {
+		return
+	}
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	for p := range idx.pages {
+		if _, ok := keep[p]; !ok {
+			delete(idx.pages, p)
+		}
+	}
+}
+
+// sorted returns the pages in the index, sorted by path.
+func (idx *metadataIndex) sorted() []*pageMeta {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	pages := make([]*pageMeta, 0, len(idx.pages))
+	for _, page := range idx.pages {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+	return pages
+}
+
+// write writes the index to file, sorted by path.
+func (idx *metadataIndex) write(file string) error {
+	p, err := json.Marshal(idx.sorted())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, p, 0644)
+}
+
+// readPageMeta parses the metadata of the manpage written to relpath, decompressing it if needed.
+func readPageMeta(ctx context.Context, relpath string) (*pageMeta, error) {
+	f, err := os.Open(relpath)
+	if err != nil {
+		return nil, err
+	}
+	defer logClose(ctx, f)
+
+	r, err := newPageDecompressor(pageCompression(relpath), f)
+	if err != nil {
+		return nil, err
+	}
+	defer logClose(ctx, r)
+
+	meta, err := parsePageMeta(io.LimitReader(r, maxPageParseSize))
+	if err != nil {
+		return nil, err
+	}
+	meta.Path = filepath.ToSlash(relpath)
+	return meta, nil
+}
+
+// linkMeta returns the metadata of a manpage link at relpath. lname is the link target as created:
+// relative to the link's directory for symlinks and to the output directory for hard links.
+func linkMeta(symlink bool, relpath, lname string) *pageMeta {
+	target := lname
+	if symlink {
+		target = filepath.Join(filepath.Dir(relpath), lname)
+	}
+	return &pageMeta{
+		Path: filepath.ToSlash(relpath),
+		Link: filepath.ToSlash(target),
+	}
+}
+
+// parsePageMeta reads the title, section, names, and description of a man(7) or mdoc(7) manpage
+// from its header macros and NAME section, and the manpages it refers to from its SEE ALSO section.
+func parsePageMeta(r io.Reader) (*pageMeta, error) {
+	meta := &pageMeta{}
+	var (
+		section  string
+		nameText []string
+		seeAlso  []string
+	)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		macro, args := roffLine(line)
+		switch macro {
+		case "":
+			switch section {
+			case "NAME":
+				nameText = append(nameText, line)
+			case "SEE ALSO":
+				seeAlso = append(seeAlso, line)
+			}
+		case `\"`:
+		case "TH", "Dt":
+			if len(args) > 0 && meta.Title == "" {
+				meta.Title = roffText(args[0])
+			}
+			if len(args) > 1 && meta.Section == "" {
+				meta.Section = roffText(args[1])
+			}
+		case "SH", "Sh":
+			section = strings.ToUpper(roffText(strings.Join(args, " ")))
+		case "Nm":
+			if section == "NAME" {
+				for _, arg := range args {
+					if name := roffText(arg); name != "" && name != "," {
+						meta.Names = append(meta.Names, name)
+					}
+				}
+			}
+		case "Nd":
+			if section == "NAME" {
+				meta.Description = roffText(strings.Join(args, " "))
+			}
+		case "Xr":
+			if section == "SEE ALSO" && len(args) > 1 {
+				meta.SeeAlso = append(meta.SeeAlso, roffText(args[0])+"("+roffText(args[1])+")")
+			}
+		case "BR", "RB", "IR", "RI", "BI", "IB":
+			// Alternating font macros join their arguments without spaces, e.g. .BR foo (1)
+			switch section {
+			case "NAME":
+				nameText = append(nameText, strings.Join(args, ""))
+			case "SEE ALSO":
+				seeAlso = append(seeAlso, strings.Join(args, ""))
+			}
+		default:
+			// Other macros inside NAME and SEE ALSO, such as .B, contribute text.
+			switch section {
+			case "NAME":
+				nameText = append(nameText, strings.Join(args, " "))
+			case "SEE ALSO":
+				seeAlso = append(seeAlso, strings.Join(args, " "))
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(nameText) > 0 {
+		names, desc := splitNameLine(strings.Join(nameText, " "))
+		if len(meta.Names) == 0 {
+			meta.Names = names
+		}
+		if meta.Description == "" {
+			meta.Description = desc
+		}
+	}
+	for _, m := range manRefPattern.FindAllStringSubmatch(roffText(strings.Join(seeAlso, " ")), -1) {
+		meta.SeeAlso = append(meta.SeeAlso, m[1]+"("+m[2]+")")
+	}
+	return meta, nil
+}
+
+// manRefPattern matches manpage references such as foo(1) and Foo::Bar(3pm) in plain text.
+var manRefPattern = regexp.MustCompile(`([A-Za-z0-9_][A-Za-z0-9_.:+-]*)\s*\(([0-9n][A-Za-z0-9]*)\)`)
+
+// splitNameLine splits the text of a man(7) NAME section, e.g. "foo, bar \- do things", into the
+// names and description.
+func splitNameLine(text string) (names []string, desc string) {
+	sep := strings.Index(text, `\-`)
+	seplen := 2
+	if sep == -1 {
+		sep, seplen = strings.Index(text, " - "), 3
+	}
+	nameList := text
+	if sep != -1 {
+		nameList, desc = text[:sep], roffText(text[sep+seplen:])
+	}
+	for _, name := range strings.Split(nameList, ",") {
+		if name = roffText(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, desc
+}
+
+// roffLine splits a roff line into its macro name and arguments. Text lines return an empty macro.
+func roffLine(line string) (macro string, args []string) {
+	if !strings.HasPrefix(line, ".") && !strings.HasPrefix(line, "'") {
+		return "", nil
+	}
+	line = strings.TrimLeft(line[1:], " \t")
+	if strings.HasPrefix(line, `\"`) {
+		return `\"`, nil
+	}
+	fields := roffArgs(line)
+	if len(fields) == 0 {
+		return `\"`, nil
+	}
+	return fields[0], fields[1:]
+}
+
+// roffArgs splits macro arguments on spaces, honoring double quotes and stopping at comments.
+func roffArgs(line string) (args []string) {
+	var (
+		buf    bytes.Buffer
+		quoted bool
+		inArg  bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line) && line[i+1] == '"' && !quoted:
+			i = len(line)
+			continue
+		case c == '"' && quoted && i+1 < len(line) && line[i+1] == '"':
+			buf.WriteByte('"')
+			i++
+			continue
+		case c == '"' && (quoted || !inArg):
+			quoted = !quoted
+			inArg = true
+			continue
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, buf.String())
+				buf.Reset()
+				inArg = false
+			}
+			continue
+		case c == '\\' && i+1 < len(line):
+			buf.WriteByte(c)
+			i++
+			c = line[i]
+		}
+		buf.WriteByte(c)
+		inArg = true
+	}
+	if inArg {
+		args = append(args, buf.String())
+	}
+	return args
+}
+
+// roffEscapes maps common roff special characters to plain text.
+var roffEscapes = map[string]string{
+	"em": "—", "en": "–", "hy": "-", "aq": "'", "dq": "\"",
+	"lq": "“", "rq": "”", "oq": "‘", "cq": "’",
+	"Fo": "«", "Fc": "»", "co": "©", "rg": "®",
+}
+
+// roffText removes font changes and other escapes from roff text, leaving plain text.
+func roffText(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 >= len(s) {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case '-', '\\', '.', '\'', '`':
+			buf.WriteByte(s[i])
+		case 'e':
+			buf.WriteByte('\\')
+		case ' ', '~':
+			buf.WriteByte(' ')
+		case 'f', 'F', '*', 'n':
+			// Font, family, string, and register escapes: \fB, \f(BI, \f[BI]
+			if i+1 < len(s) {
+				i = skipEscapeName(s, i+1)
+			}
+		case '(':
+			if i+2 < len(s) {
+				buf.WriteString(roffEscapes[s[i+1:i+3]])
+				i += 2
+			} else {
+				i = len(s)
+			}
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end == -1 {
+				i = len(s)
+				continue
+			}
+			buf.WriteString(roffEscapes[s[i+1:i+end]])
+			i += end
+		}
+		// Anything else (\&, \:, \%, \c, ...) produces no text.
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// skipEscapeName returns the index of the last byte of the escape name starting at s[i], which may
+// be a single character, two characters prefixed with '(', or bracketed.
+func skipEscapeName(s string, i int) int {
+	switch s[i] {
+	case '(':
+		if i+2 < len(s) {
+			return i + 2
+		}
+		return len(s)
+	case '[':
+		if end := strings.IndexByte(s[i:], ']'); end != -1 {
+			return i + end
+		}
+		return len(s)
+	}
+	return i
+}
+
+// pageMeta returns the metadata of the manpage or manpage link written to relpath from pkg. Errors
+// reading the manpage are logged and leave only the path and package set.
+func (d *Dumper) pageMeta(ctx context.Context, pkg *xrepo.Package, typeflag byte, relpath, lname string) *pageMeta {
+	var meta *pageMeta
+	if typeflag == tar.TypeReg {
+		var err error
+		if meta, err = readPageMeta(ctx, relpath); err != nil {
+			Warn(ctx, "Unable to read manpage metadata", zap.Error(err))
+			meta = &pageMeta{Path: filepath.ToSlash(relpath)}
+		}
+	} else {
+		meta = linkMeta(typeflag == tar.TypeSymlink, relpath, lname)
+	}
+	meta.Package = pkg.PackageVersion
+	return meta
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePageMeta(t *testing.T) {
+	cases := []struct {
+		name string
+		page string
+		want pageMeta
+	}{
+		{
+			name: "man",
+			page: `.\" Comment
+.TH FOO 1 "2020-01-01" "foo 1.0" "User Commands"
+.SH NAME
+foo, bar \- do \fBthings\fR
+.SH SYNOPSIS
+.B foo
+.SH "SEE ALSO"
+.BR baz (1),
+qux(8), \fBquux\fP(3pm)
+`,
+			want: pageMeta{
+				Title:       "FOO",
+				Section:     "1",
+				Names:       []string{"foo", "bar"},
+				Description: "do things",
+				SeeAlso:     []string{"baz(1)", "qux(8)", "quux(3pm)"},
+			},
+		},
+		{
+			name: "man with name on a macro line",
+			page: `.TH "FOO BAR" 3p
+.SH NAME
+.B foo
+\- a function with a \(lqquoted\(rq name
+`,
+			want: pageMeta{
+				Title:       "FOO BAR",
+				Section:     "3p",
+				Names:       []string{"foo"},
+				Description: "a function with a “quoted” name",
+			},
+		},
+		{
+			name: "mdoc",
+			page: `.Dd January 1, 2020
+.Dt FOO 8
+.Os
+.Sh NAME
+.Nm foo ,
+.Nm bar
+.Nd configure the foo daemon
+.Sh SEE ALSO
+.Xr baz 1 ,
+.Xr qux 5
+`,
+			want: pageMeta{
+				Title:       "FOO",
+				Section:     "8",
+				Names:       []string{"foo", "bar"},
+				Description: "configure the foo daemon",
+				SeeAlso:     []string{"baz(1)", "qux(5)"},
+			},
+		},
+		{
+			name: "no NAME section",
+			page: `.TH FOO 1
+.SH DESCRIPTION
+foo \- not a name line
+`,
+			want: pageMeta{Title: "FOO", Section: "1"},
+		},
+		{
+			name: "name without description",
+			page: `.TH FOO 1
+.SH NAME
+foo
+`,
+			want: pageMeta{Title: "FOO", Section: "1", Names: []string{"foo"}},
+		},
+		{
+			name: "no header",
+			page: `.SH NAME
+foo - plain hyphen
+`,
+			want: pageMeta{Names: []string{"foo"}, Description: "plain hyphen"},
+		},
+		{
+			name: "first header wins",
+			page: `.TH FOO 1
+.TH BAR 2
+`,
+			want: pageMeta{Title: "FOO", Section: "1"},
+		},
+		{
+			name: "garbled",
+			page: `.TH "FOO 1
+.SH NAME
+foo\fB \- truncated escapes \(
+.SH SEE ALSO
+\fBbar\f[
+.Xr
+.Nm not a name outside NAME
+`,
+			want: pageMeta{Title: "FOO 1", Names: []string{"foo"}, Description: "truncated escapes"},
+		},
+		{
+			name: "not roff",
+			page: "\x00\x01binary\xff\n..\n.\n'\n",
+			want: pageMeta{},
+		},
+		{
+			name: "empty",
+			page: "",
+			want: pageMeta{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parsePageMeta(strings.NewReader(c.page))
+			if err != nil {
+				t.Fatalf("parsePageMeta: %v", err)
+			}
+			if !reflect.DeepEqual(*got, c.want) {
+				t.Errorf("parsePageMeta = %+v; want %+v", *got, c.want)
+			}
+		})
+	}
+}
+
+func TestParsePageMetaLongLine(t *testing.T) {
+	page := ".TH FOO 1\n.SH NAME\nfoo \\- " + strings.Repeat("x", 2<<20) + "\n"
+	if _, err := parsePageMeta(strings.NewReader(page)); err == nil {
+		t.Error("parsePageMeta with an overlong line succeeded; want error")
+	}
+}
+
+func TestRoffText(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string
+	}{
+		{`\fBfoo\fR`, "foo"},
+		{`\f(BIfoo\fP`, "foo"},
+		{`\f[BI]foo\f[]`, "foo"},
+		{`foo\-bar`, "foo-bar"},
+		{`\(lqfoo\(rq`, "“foo”"},
+		{`\[em]foo`, "—foo"},
+		{`\*(Lxfoo`, "foo"},
+		{`foo\&.`, "foo."},
+		{`  foo\ bar  `, "foo bar"},
+		{`foo\`, `foo\`},
+		{`foo\(`, "foo"},
+		{`foo\(l`, "foo"},
+		{`foo\[em`, "foo"},
+		{`foo\f`, "foo"},
+		{`foo\f[B`, "foo"},
+	}
+	for _, c := range cases {
+		if got := roffText(c.s); got != c.want {
+			t.Errorf("roffText(%q) = %q; want %q", c.s, got, c.want)
+		}
+	}
+}
+
+func TestMetadataIndexPrune(t *testing.T) {
+	idx := &metadataIndex{pages: map[string]*pageMeta{}}
+	for _, p := range []string{"man1/foo.1", "man1/bar.1", "man5/foo.conf.5"} {
+		idx.set(&pageMeta{Path: p})
+	}
+	idx.prune(map[string]struct{}{"man1/foo.1": {}, "man8/gone.8": {}})
+
+	var got []string
+	for _, page := range idx.sorted() {
+		got = append(got, page.Path)
+	}
+	if want := []string{"man1/foo.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pages after prune = %q; want %q", got, want)
+	}
+
+	idx.prune(nil)
+	if pages := idx.sorted(); len(pages) != 0 {
+		t.Errorf("pages after pruning everything = %d; want 0", len(pages))
+	}
+
+	// A nil index, as when no metadata index is kept, ignores prune.
+	var none *metadataIndex
+	none.prune(map[string]struct{}{})
+}
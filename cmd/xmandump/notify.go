@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notifyStatusInterval is how often progress is reported to systemd.
+const notifyStatusInterval = 5 * time.Second
+
+// systemdNotifier reports the progress of a run to systemd when xmandump runs as a Type=notify
+// service: READY=1 once started, STATUS= with progress, STOPPING=1 on exit, and WATCHDOG=1
+// keep-alives if WatchdogSec= is set. While progress is required, keep-alives are only sent if the
+// run has made progress since the last one, so that a stalled run trips the watchdog. All methods
+// may be called on a nil *systemdNotifier, in which case they do nothing.
+type systemdNotifier struct {
+	conn     *net.UnixConn
+	status   *runStatus
+	interval time.Duration // Zero if the watchdog is disabled
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	progress int32 // atomic; non-zero if keep-alives require progress
+}
+
+// startSystemdNotifier connects to the socket in NOTIFY_SOCKET and sends READY=1. It returns nil if
+// NOTIFY_SOCKET is unset.
+func startSystemdNotifier(status *runStatus) (*systemdNotifier, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	n := &systemdNotifier{
+		conn:     conn,
+		status:   status,
+		interval: watchdogInterval(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := n.notify("READY=1\nSTATUS=Starting"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go n.run()
+	return n, nil
+}
+
+// watchdogInterval returns how often to send WATCHDOG=1, which is half the watchdog timeout set by
+// systemd, or zero if the watchdog is disabled or meant for another process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+func (n *systemdNotifier) run() {
+	defer close(n.done)
+	interval := notifyStatusInterval
+	if n.interval > 0 && n.interval < interval {
+		interval = n.interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last statusSnapshot
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stop:
+			return
+		}
+		snap := n.status.snapshot()
+		state := fmt.Sprintf("STATUS=Processed %d/%d packages, %d pages written", snap.Done, snap.Packages, snap.PagesWritten)
+		advanced := !snap.LastProgress.Equal(last.LastProgress) || snap.BytesRead != last.BytesRead
+		if n.interval > 0 && (advanced || atomic.LoadInt32(&n.progress) == 0) {
+			state = "WATCHDOG=1\n" + state
+		}
+		last = snap
+		_ = n.notify(state)
+	}
+}
+
+// requireProgress sets whether keep-alives are only sent when the run has made progress. It is set
+// while packages are processed, since other phases don't report progress.
+func (n *systemdNotifier) requireProgress(required bool) {
+	if n == nil {
+		return
+	}
+	var v int32
+	if required {
+		v = 1
+	}
+	atomic.StoreInt32(&n.progress, v)
+}
+
+func (n *systemdNotifier) notify(state string) error {
+	_, err := n.conn.Write([]byte(state))
+	return err
+}
+
+// Stop sends STOPPING=1 and stops sending status updates. It may be called more than once.
+func (n *systemdNotifier) Stop() {
+	if n == nil {
+		return
+	}
+	n.stopOnce.Do(func() {
+		close(n.stop)
+		<-n.done
+		_ = n.notify("STOPPING=1")
+		n.conn.Close()
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileOwner is the owner given to files and directories created in the output tree.
+type fileOwner struct {
+	UID, GID int
+}
+
+// parseOwner parses an owner of the form user[:group], where user and group may be names or
+// numeric IDs. If group is omitted, the user's primary group is used. If user is empty, only the
+// group is set.
+func parseOwner(s string) (*fileOwner, error) {
+	username, groupname := s, ""
+	if sep := strings.IndexByte(s, ':'); sep != -1 {
+		username, groupname = s[:sep], s[sep+1:]
+	}
+	uid, gid, err := lookupIDs(username, groupname)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOwner{UID: uid, GID: gid}, nil
+}
+
+// chown sets the owner of each path without following symlinks.
+func (o *fileOwner) chown(paths ...string) error {
+	if o == nil {
+		return nil
+	}
+	for _, p := range paths {
+		if err := os.Lchown(p, o.UID, o.GID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chownDirs sets the owner of dir and each of its parents, up to but not including the output
+// directory.
+func (o *fileOwner) chownDirs(dir string) error {
+	if o == nil {
+		return nil
+	}
+	for ; dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if err := o.chown(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"howett.net/plist"
+)
+
+// Package compression formats.
+const (
+	formatXZ   = "xz"
+	formatZstd = "zstd"
+	formatTar  = "tar" // Uncompressed
+)
+
+// unsupportedFormatError is returned by detectFormat if a package's compression format is not
+// supported.
+type unsupportedFormatError struct {
+	File string
+	MIME string
+}
+
+func (e *unsupportedFormatError) Error() string {
+	return fmt.Sprintf("Compression format for %s is not supported (%s)", e.File, e.MIME)
+}
+
+// detectFormat returns the compression format of the package file at file.
+func detectFormat(file string) (string, error) {
+	mime, err := mimetype.DetectFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case mime.Is("application/x-xz"):
+		return formatXZ, nil
+	case mime.Is("application/zstd"):
+		return formatZstd, nil
+	case mime.Is("application/x-tar"):
+		return formatTar, nil
+	}
+	return "", &unsupportedFormatError{File: file, MIME: mime.String()}
+}
+
+// newDecompressor returns a reader that decompresses r using the given compression format. Any
+// zstd options are passed to the zstd decoder.
+func newDecompressor(format string, r io.Reader, zstdOpts ...zstd.DOption) (io.ReadCloser, error) {
+	switch format {
+	case formatXZ:
+		xzDec, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xzDec), nil
+	case formatZstd:
+		zstdDec, err := zstd.NewReader(r, zstdOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return zstdDec.IOReadCloser(), nil
+	case formatTar:
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("Compression format %s is not supported", format)
+}
+
+// defaultPlistMemLimit is the default size above which files lists are buffered in a temporary file
+// rather than in memory.
+const defaultPlistMemLimit = 4 << 20
+
+// filesListError is returned by readFilesList if a files.plist is found but cannot be decoded.
+type filesListError struct {
+	Err error
+}
+
+func (e *filesListError) Error() string {
+	return "invalid files list: " + e.Err.Error()
+}
+
+// readFilesList reads tf up to and including the package's files.plist and decodes it. If the
+// package has no files.plist, it returns an empty packageFiles and found is false, and tf has been
+// read to its end. Files lists larger than memLimit bytes are buffered in a temporary file. If the
+// files list cannot be decoded, the error is a *filesListError.
+func readFilesList(tf *tar.Reader, memLimit int64) (files packageFiles, found bool, err error) {
+	for {
+		hdr, err := tf.Next()
+		if err == io.EOF {
+			return files, false, nil
+		} else if err != nil {
+			return files, false, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg || isArchiveMetadata(hdr) {
+			continue
+		}
+
+		pkgfile := path.Clean(hdr.Name)
+		if pkgfile != "files.plist" {
+			continue
+		}
+
+		if err := decodeFilesList(tf, memLimit, &files); err != nil {
+			return packageFiles{}, true, &filesListError{Err: err}
+		}
+		return files, true, nil
+	}
+}
+
+// isArchiveMetadata returns whether hdr is archive metadata rather than a file in the package. This
+// covers PAX global headers, which archive/tar returns as entries, and any PAX or GNU long name
+// headers that archive/tar did not merge into the entry that follows (e.g., if written by a tar that
+// produced them in an unexpected order). Metadata entries must never be matched against manpages
+// or the files list.
+func isArchiveMetadata(hdr *tar.Header) bool {
+	switch hdr.Typeflag {
+	case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+		return true
+	}
+
+	switch path.Base(hdr.Name) {
+	case "pax_global_header", "@LongLink":
+		return true
+	}
+	return false
+}
+
+// decodeFilesList decodes a files.plist from r into files. Files lists larger than memLimit bytes
+// are buffered in a temporary file.
+func decodeFilesList(r io.Reader, memLimit int64, files *packageFiles) error {
+	buffer, cleanup, err := bufferReader(r, memLimit)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return plist.NewDecoder(buffer).Decode(files)
+}
+
+type packageFiles struct {
+	Files []packageFile `plist:"files"`
+	Dirs  []packageFile `plist:"dirs"`
+	Links []packageFile `plist:"links"`
+}
+
+func (p *packageFiles) Empty() bool {
+	return len(p.Dirs) == 0
+}
+
+// manpages returns the set of manpage files and links listed in the receiver, as tar entry names
+// normalized by manpageKey (i.e., ./usr/share/man/...). It returns nil if the package has no manpage
+// directories.
+func (p *packageFiles) manpages() map[string]struct{} {
+	if p.Empty() {
+		return nil
+	}
+
+	hasManDirs := false
+	for _, dir := range p.Dirs {
+		if strings.HasPrefix(path.Clean(dir.File), manDirsPrefix) {
+			hasManDirs = true
+			break
+		}
+	}
+	if !hasManDirs {
+		return nil
+	}
+
+	manpages := map[string]struct{}{}
+	for _, file := range append(p.Files, p.Links...) {
+		if strings.HasPrefix(file.File, manDirsPrefix) {
+			manpages[manpageKey(file.File)] = struct{}{}
+		}
+	}
+	return manpages
+}
+
+// manpageKey normalizes a path from a files list or tar entry name to the form ./usr/share/man/...,
+// so that the two can be compared regardless of leading slashes or dots.
+func manpageKey(name string) string {
+	return "./" + strings.TrimLeft(path.Clean("/"+name), "/")
+}
+
+// sortedKeys returns the keys of set in sorted order.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type packageFile struct {
+	File string `plist:"file"`
+}
+
+// bufferReader reads all of r and returns it as an io.ReadSeeker. If r holds more than memLimit
+// bytes, its content is spilled to a temporary file instead of being held in memory. The returned
+// cleanup function must be called once the reader is no longer needed.
+func bufferReader(r io.Reader, memLimit int64) (rs io.ReadSeeker, cleanup func(), err error) {
+	buf := getBuffer()
+	defer func() {
+		if err != nil || cleanup == nil {
+			putBuffer(buf)
+		}
+	}()
+
+	n, err := io.Copy(buf, io.LimitReader(r, memLimit+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if n <= memLimit {
+		return bytes.NewReader(buf.Bytes()), func() { putBuffer(buf) }, nil
+	}
+
+	f, err := ioutil.TempFile("", "xmandump-plist-")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		if _, err = copyBuffer(f, r); err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+	putBuffer(buf)
+	return f, remove, nil
+}
+
+const (
+	copyBufferSize  = 32 * 1024
+	maxPooledBuffer = 16 << 20
+)
+
+// bufferPool holds buffers used to read files lists. copyBufferPool holds buffers used to copy files
+// out of packages. Pooling these keeps allocation (and garbage) flat across packages.
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+	copyBufferPool = sync.Pool{
+		New: func() interface{} {
+			p := make([]byte, copyBufferSize)
+			return &p
+		},
+	}
+)
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool unless it has grown too large to be worth keeping.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// copyBuffer is io.Copy using a pooled buffer.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	p := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(p)
+	return io.CopyBuffer(dst, src, *p)
+}
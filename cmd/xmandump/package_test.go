@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsArchiveMetadata(t *testing.T) {
+	cases := []struct {
+		name string
+		hdr  tar.Header
+		want bool
+	}{
+		{"pax global header", tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header"}, true},
+		{"pax extended header", tar.Header{Typeflag: tar.TypeXHeader, Name: "./PaxHeaders/foo.1"}, true},
+		{"gnu long name", tar.Header{Typeflag: tar.TypeGNULongName, Name: "././@LongLink"}, true},
+		{"gnu long link", tar.Header{Typeflag: tar.TypeGNULongLink, Name: "././@LongLink"}, true},
+		{"stray long link as file", tar.Header{Typeflag: tar.TypeReg, Name: "././@LongLink"}, true},
+		{"stray global header as file", tar.Header{Typeflag: tar.TypeReg, Name: "pax_global_header"}, true},
+		{"manpage", tar.Header{Typeflag: tar.TypeReg, Name: "./usr/share/man/man1/foo.1"}, false},
+		{"files list", tar.Header{Typeflag: tar.TypeReg, Name: "./files.plist"}, false},
+		{"symlink", tar.Header{Typeflag: tar.TypeSymlink, Name: "./usr/share/man/man1/bar.1", Linkname: "foo.1"}, false},
+		{"manpage named like metadata", tar.Header{Typeflag: tar.TypeReg, Name: "./usr/share/man/man1/LongLink.1"}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isArchiveMetadata(&c.hdr); got != c.want {
+				t.Errorf("isArchiveMetadata(%q, %q) = %v; want %v", c.hdr.Typeflag, c.hdr.Name, got, c.want)
+			}
+		})
+	}
+}
+
+const testFilesList = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>dirs</key>
+	<array><dict><key>file</key><string>/usr/share/man/man1</string></dict></array>
+	<key>files</key>
+	<array><dict><key>file</key><string>/usr/share/man/man1/foo.1</string></dict></array>
+</dict>
+</plist>
+`
+
+// testTar returns a tar archive of entries, each written with its header and body.
+func testTar(t *testing.T, entries []testTarEntry) *tar.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("WriteHeader(%q): %v", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("Write(%q): %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(&buf)
+}
+
+type testTarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func TestReadFilesList(t *testing.T) {
+	longName := "./usr/share/man/man1/" + strings.Repeat("x", 120) + ".1"
+	cases := []struct {
+		name      string
+		entries   []testTarEntry
+		wantFound bool
+		wantFiles []packageFile
+	}{
+		{
+			name: "plain",
+			entries: []testTarEntry{
+				{tar.Header{Typeflag: tar.TypeReg, Name: "./props.plist"}, "<plist/>"},
+				{tar.Header{Typeflag: tar.TypeReg, Name: "./files.plist"}, testFilesList},
+			},
+			wantFound: true,
+			wantFiles: []packageFile{{File: "/usr/share/man/man1/foo.1"}},
+		},
+		{
+			name: "pax global header first",
+			entries: []testTarEntry{
+				{tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "files.plist"}}, ""},
+				{tar.Header{Typeflag: tar.TypeReg, Name: "./files.plist"}, testFilesList},
+			},
+			wantFound: true,
+			wantFiles: []packageFile{{File: "/usr/share/man/man1/foo.1"}},
+		},
+		{
+			name: "gnu long name before files list",
+			entries: []testTarEntry{
+				{tar.Header{Typeflag: tar.TypeReg, Name: longName, Format: tar.FormatGNU}, "manpage"},
+				{tar.Header{Typeflag: tar.TypeReg, Name: "./files.plist"}, testFilesList},
+			},
+			wantFound: true,
+			wantFiles: []packageFile{{File: "/usr/share/man/man1/foo.1"}},
+		},
+		{
+			name: "stray long link entry is not a files list",
+			entries: []testTarEntry{
+				{tar.Header{Typeflag: tar.TypeReg, Name: "././@LongLink"}, "./files.plist"},
+			},
+			wantFound: false,
+		},
+		{
+			name: "no files list",
+			entries: []testTarEntry{
+				{tar.Header{Typeflag: tar.TypeReg, Name: "./usr/share/man/man1/foo.1"}, "manpage"},
+			},
+			wantFound: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			files, found, err := readFilesList(testTar(t, c.entries), defaultPlistMemLimit)
+			if err != nil {
+				t.Fatalf("readFilesList: %v", err)
+			}
+			if found != c.wantFound {
+				t.Errorf("found = %v; want %v", found, c.wantFound)
+			}
+			if !reflect.DeepEqual(files.Files, c.wantFiles) {
+				t.Errorf("files = %v; want %v", files.Files, c.wantFiles)
+			}
+		})
+	}
+}
+
+func TestManpageKey(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"./usr/share/man/man1/foo.1", "./usr/share/man/man1/foo.1"},
+		{"/usr/share/man/man1/foo.1", "./usr/share/man/man1/foo.1"},
+		{"usr/share/man/man1/foo.1", "./usr/share/man/man1/foo.1"},
+		{".//usr/share/man/./man1/foo.1", "./usr/share/man/man1/foo.1"},
+	}
+	for _, c := range cases {
+		if got := manpageKey(c.name); got != c.want {
+			t.Errorf("manpageKey(%q) = %q; want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Suffixes of compressed manpages that can be decompressed on extraction.
+const (
+	pageSuffixGzip  = ".gz"
+	pageSuffixBzip2 = ".bz2"
+	pageSuffixXZ    = ".xz"
+)
+
+var pageSuffixes = []string{pageSuffixGzip, pageSuffixBzip2, pageSuffixXZ}
+
+// pageCompression returns the compressed manpage suffix of name, or an empty string if name does
+// not have one.
+func pageCompression(name string) string {
+	for _, suffix := range pageSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// trimPageCompression returns name without its compressed manpage suffix, if it has one.
+func trimPageCompression(name string) string {
+	return strings.TrimSuffix(name, pageCompression(name))
+}
+
+// newPageDecompressor returns a reader for the decompressed contents of a manpage compressed with
+// the given suffix. If suffix is empty, r is returned as-is.
+func newPageDecompressor(suffix string, r io.Reader) (io.ReadCloser, error) {
+	switch suffix {
+	case pageSuffixGzip:
+		return gzip.NewReader(r)
+	case pageSuffixBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case pageSuffixXZ:
+		xzDec, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xzDec), nil
+	}
+	return io.NopCloser(r), nil
+}
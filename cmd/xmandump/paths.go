@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errUnsafePath = errors.New("path refers to a location outside of the output directory")
+
+// isRelativeTreePath returns whether file is a relative path that does not refer to anything
+// outside of the current directory.
+func isRelativeTreePath(file string) bool {
+	return !filepath.IsAbs(file) && !strings.Contains(filepath.ToSlash(file), "../")
+}
+
+// checkTreePath returns errUnsafePath if relpath, a path relative to the output directory, is
+// absolute, empty, or contains any parent directory references.
+func checkTreePath(relpath string) error {
+	if relpath == "" || filepath.IsAbs(relpath) {
+		return errUnsafePath
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(relpath), "/") {
+		if elem == ".." {
+			return errUnsafePath
+		}
+	}
+	if filepath.Clean(relpath) != relpath {
+		return errUnsafePath
+	}
+	return nil
+}
+
+// checkPackagePath returns errUnsafePath if name, a path from a package archive, contains any
+// parent directory references. These are rejected outright, even if the cleaned path would resolve
+// to a manpage, since no legitimate package contains them.
+func checkPackagePath(name string) error {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return errUnsafePath
+		}
+	}
+	return nil
+}
+
+// resolveLinkname resolves linkname, the target of a symlink at pkgfile (a cleaned package path),
+// and returns a clean target relative to the link's directory. Absolute targets are rewritten to
+// relative ones, and relative targets are cleaned, so that the returned target resolves to the path
+// that was checked even if the link's directory holds symlinks named like its components. It
+// returns errUnsafePath if the target resolves to anything outside of the manpage tree.
+func resolveLinkname(pkgfile, linkname string) (string, error) {
+	if linkname == "" {
+		return "", errUnsafePath
+	}
+
+	dir := path.Dir(pkgfile)
+	target := linkname
+	if path.IsAbs(target) {
+		target = strings.TrimLeft(path.Clean(target), "/")
+	} else {
+		target = path.Join(dir, target)
+	}
+
+	if !strings.HasPrefix(target, manPathTrimPrefix) {
+		return "", errUnsafePath
+	}
+
+	rel, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(target))
+	if err != nil {
+		return "", errUnsafePath
+	}
+	return rel, nil
+}
+
+// resolveHardLink resolves linkname, the target of a hard link in a package, to a path relative to
+// the output directory. It returns errUnsafePath if the target is not a manpage.
+func resolveHardLink(linkname string) (string, error) {
+	if err := checkPackagePath(linkname); err != nil {
+		return "", err
+	}
+
+	target := strings.TrimLeft(path.Clean(linkname), "/")
+	if !strings.HasPrefix(target, manPathPrefix) {
+		return "", errUnsafePath
+	}
+
+	relpath := filepath.FromSlash(strings.TrimPrefix(target, manPathTrimPrefix))
+	if err := checkTreePath(relpath); err != nil {
+		return "", err
+	}
+	return relpath, nil
+}
+
+// checkNoSymlinkDirs returns errUnsafePath if any component of reldir, a directory relative to the
+// output directory, is a symlink. Components that do not exist yet are ignored.
+func checkNoSymlinkDirs(reldir string) error {
+	dir := ""
+	for _, elem := range strings.Split(filepath.ToSlash(reldir), "/") {
+		if elem == "." || elem == "" {
+			continue
+		}
+		dir = filepath.Join(dir, elem)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errUnsafePath
+		}
+	}
+	return nil
+}
+
+// removeExisting removes the file at relpath, if there is one.
+func removeExisting(relpath string) error {
+	if _, err := os.Lstat(relpath); err != nil {
+		return nil
+	}
+	return os.Remove(relpath)
+}
+
+// writeTreeFile writes data to relpath in the output tree, replacing any existing file without
+// following symlinks.
+func writeTreeFile(relpath string, data []byte) error {
+	if err := removeExisting(relpath); err != nil {
+		return err
+	}
+	f, err := createNoFollow(relpath, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
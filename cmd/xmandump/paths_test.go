@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckTreePath(t *testing.T) {
+	cases := []struct {
+		relpath string
+		safe    bool
+	}{
+		{"man1/foo.1", true},
+		{"current/man1/foo.1", true},
+		{"man1/..foo.1", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../man1/foo.1", false},
+		{"man1/../../foo.1", false},
+		{"man1/..", false},
+		{"..", false},
+		{"./man1/foo.1", false},
+		{"man1//foo.1", false},
+		{"man1/foo.1/", false},
+	}
+	for _, c := range cases {
+		err := checkTreePath(c.relpath)
+		if c.safe && err != nil {
+			t.Errorf("checkTreePath(%q) = %v; want nil", c.relpath, err)
+		} else if !c.safe && err != errUnsafePath {
+			t.Errorf("checkTreePath(%q) = %v; want %v", c.relpath, err, errUnsafePath)
+		}
+	}
+}
+
+func TestCheckPackagePath(t *testing.T) {
+	cases := []struct {
+		name string
+		safe bool
+	}{
+		{"./usr/share/man/man1/foo.1", true},
+		{"usr/share/man/man1/foo.1", true},
+		{"/usr/share/man/man1/foo.1", true},
+		{"./usr/share/man/man1/..foo.1", true},
+		{"./usr/share/man/man1/../../../../etc/passwd", false},
+		{"./usr/share/man/../man/man1/foo.1", false},
+		{"../usr/share/man/man1/foo.1", false},
+		{"..", false},
+	}
+	for _, c := range cases {
+		err := checkPackagePath(c.name)
+		if c.safe && err != nil {
+			t.Errorf("checkPackagePath(%q) = %v; want nil", c.name, err)
+		} else if !c.safe && err != errUnsafePath {
+			t.Errorf("checkPackagePath(%q) = %v; want %v", c.name, err, errUnsafePath)
+		}
+	}
+}
+
+func TestResolveLinkname(t *testing.T) {
+	cases := []struct {
+		pkgfile  string
+		linkname string
+		want     string // Empty if the target is unsafe
+	}{
+		{"usr/share/man/man1/bar.1", "foo.1", "foo.1"},
+		{"usr/share/man/man1/bar.1", "../man8/foo.8", "../man8/foo.8"},
+		{"usr/share/man/man1/bar.1", "/usr/share/man/man1/foo.1", "foo.1"},
+		{"usr/share/man/man1/bar.1", "/usr/share/man/man8/foo.8", "../man8/foo.8"},
+		{"usr/share/man/de/man1/bar.1", "/usr/share/man/man1/foo.1", "../../man1/foo.1"},
+		{"usr/share/man/man1/bar.1", "//usr/share/man/./man1/foo.1", "foo.1"},
+		{"usr/share/man/man1/bar.1", "./foo.1", "foo.1"},
+		{"usr/share/man/man1/bar.1", "sub/../foo.1", "foo.1"},
+		{"usr/share/man/man1/bar.1", "sub/../../man8/foo.8", "../man8/foo.8"},
+		{"usr/share/man/man1/bar.1", "../man1/./foo.1", "foo.1"},
+		{"usr/share/man/man1/bar.1", "sub/../../../../../etc/passwd", ""},
+		{"usr/share/man/man1/bar.1", "", ""},
+		{"usr/share/man/man1/bar.1", "../../../../etc/passwd", ""},
+		{"usr/share/man/man1/bar.1", "../..", ""},
+		{"usr/share/man/man1/bar.1", "../../man", ""},
+		{"usr/share/man/man1/bar.1", "/etc/passwd", ""},
+		{"usr/share/man/man1/bar.1", "/usr/share/man/../../../etc/passwd", ""},
+		{"usr/share/man/man1/bar.1", "/usr/share/manual/foo.1", ""},
+	}
+	for _, c := range cases {
+		got, err := resolveLinkname(c.pkgfile, c.linkname)
+		if c.want == "" {
+			if err != errUnsafePath {
+				t.Errorf("resolveLinkname(%q, %q) = %q, %v; want error %v", c.pkgfile, c.linkname, got, err, errUnsafePath)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(c.want) {
+			t.Errorf("resolveLinkname(%q, %q) = %q, %v; want %q, nil", c.pkgfile, c.linkname, got, err, c.want)
+		}
+	}
+}
+
+func TestResolveHardLink(t *testing.T) {
+	cases := []struct {
+		linkname string
+		want     string // Empty if the target is unsafe
+	}{
+		{"./usr/share/man/man1/foo.1", "man1/foo.1"},
+		{"usr/share/man/man1/foo.1", "man1/foo.1"},
+		{"/usr/share/man/man8/foo.8.gz", "man8/foo.8.gz"},
+		{"./usr/share/man/man1/./foo.1", "man1/foo.1"},
+		{"", ""},
+		{"./usr/bin/foo", ""},
+		{"./etc/passwd", ""},
+		{"./usr/share/man/foo.1", ""},
+		{"./usr/share/man/man1/../../../../etc/passwd", ""},
+		{"../usr/share/man/man1/foo.1", ""},
+	}
+	for _, c := range cases {
+		got, err := resolveHardLink(c.linkname)
+		if c.want == "" {
+			if err != errUnsafePath {
+				t.Errorf("resolveHardLink(%q) = %q, %v; want error %v", c.linkname, got, err, errUnsafePath)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(c.want) {
+			t.Errorf("resolveHardLink(%q) = %q, %v; want %q, nil", c.linkname, got, err, c.want)
+		}
+	}
+}
+
+func TestCheckNoSymlinkDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmandump-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, d := range []string{"man1", "real/man1"} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"man8": "/tmp", "linked": "real", "real/man5": "../man1"} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		reldir string
+		safe   bool
+	}{
+		{".", true},
+		{"man1", true},
+		{"real/man1", true},
+		{"missing", true},
+		{"missing/man1", true},
+		{"man1/missing", true},
+		{"man8", false},
+		{"linked/man1", false},
+		{"real/man5", false},
+	}
+	for _, c := range cases {
+		err := checkNoSymlinkDirs(c.reldir)
+		if c.safe && err != nil {
+			t.Errorf("checkNoSymlinkDirs(%q) = %v; want nil", c.reldir, err)
+		} else if !c.safe && err != errUnsafePath {
+			t.Errorf("checkNoSymlinkDirs(%q) = %v; want %v", c.reldir, err, errUnsafePath)
+		}
+	}
+}
+
+func TestIsRelativeTreePath(t *testing.T) {
+	cases := []struct {
+		file string
+		want bool
+	}{
+		{"man1/foo.1", true},
+		{"man1/..foo.1", true},
+		{"/man1/foo.1", false},
+		{"../foo.1", false},
+		{"man1/../../foo.1", false},
+	}
+	for _, c := range cases {
+		if got := isRelativeTreePath(c.file); got != c.want {
+			t.Errorf("isRelativeTreePath(%q) = %v; want %v", c.file, got, c.want)
+		}
+	}
+}
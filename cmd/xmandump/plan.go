@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+)
+
+// changePlan lists the files that a run would change in the output tree, as printed by -plan.
+type changePlan struct {
+	Create    []string `json:"create"`
+	Overwrite []string `json:"overwrite"`
+	Delete    []string `json:"delete"`
+}
+
+// planPage records the files that would be written for the manpage at relpath without writing
+// anything. relpath is the path before any -compress suffix is added.
+func (d *Dumper) planPage(pkg *xrepo.Package, relpath string) {
+	if d.Compress {
+		relpath += ".gz"
+	}
+	paths := []string{relpath}
+	if d.Precompress {
+		for _, suffix := range precompressSuffixes {
+			paths = append(paths, relpath+suffix)
+		}
+	}
+	if d.RenderText {
+		paths = append(paths, textPath(relpath))
+	}
+	d.recordChange(d.cacheKey(pkg), paths...)
+	d.recordWrite(paths...)
+}
+
+// newChangePlan returns the plan of a run that writes the files in written and removes the files
+// in removed. Written files that already exist are overwritten.
+func newChangePlan(written, removed []string) *changePlan {
+	plan := &changePlan{Create: []string{}, Overwrite: []string{}, Delete: []string{}}
+	for _, p := range rsyncPaths(written) {
+		if _, err := os.Lstat(filepath.FromSlash(p)); err == nil {
+			plan.Overwrite = append(plan.Overwrite, p)
+		} else {
+			plan.Create = append(plan.Create, p)
+		}
+	}
+	for _, p := range rsyncPaths(removed) {
+		if isRelativeTreePath(p) {
+			plan.Delete = append(plan.Delete, p)
+		}
+	}
+	return plan
+}
+
+// write writes the plan to w as indented JSON.
+func (p *changePlan) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
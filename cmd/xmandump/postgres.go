@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// postgresBatchSize is the number of rows inserted per statement when exporting to PostgreSQL.
+const postgresBatchSize = 1000
+
+// postgresSchema creates the tables that packages and manpages are exported to.
+const postgresSchema = `CREATE TABLE IF NOT EXISTS xmandump_packages (
+	cache_key    text PRIMARY KEY,
+	pkgver       text,
+	architecture text,
+	repository   text,
+	maintainer   text
+);
+CREATE TABLE IF NOT EXISTS xmandump_pages (
+	path        text NOT NULL,
+	cache_key   text NOT NULL REFERENCES xmandump_packages ON DELETE CASCADE,
+	title       text,
+	section     text,
+	description text,
+	PRIMARY KEY (path, cache_key)
+);
+`
+
+// postgresEnvVars maps libpq connection parameters to the environment variables psql reads them
+// from.
+var postgresEnvVars = map[string]string{
+	"host":                 "PGHOST",
+	"hostaddr":             "PGHOSTADDR",
+	"port":                 "PGPORT",
+	"dbname":               "PGDATABASE",
+	"user":                 "PGUSER",
+	"password":             "PGPASSWORD",
+	"passfile":             "PGPASSFILE",
+	"service":              "PGSERVICE",
+	"options":              "PGOPTIONS",
+	"application_name":     "PGAPPNAME",
+	"client_encoding":      "PGCLIENTENCODING",
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"channel_binding":      "PGCHANNELBINDING",
+	"gssencmode":           "PGGSSENCMODE",
+	"krbsrvname":           "PGKRBSRVNAME",
+	"requiressl":           "PGREQUIRESSL",
+	"sslmode":              "PGSSLMODE",
+	"sslcert":              "PGSSLCERT",
+	"sslkey":               "PGSSLKEY",
+	"sslrootcert":          "PGSSLROOTCERT",
+	"sslcrl":               "PGSSLCRL",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+}
+
+// postgresEnviron converts a PostgreSQL connection string -- a postgres:// URI, key=value pairs,
+// or a database name -- to the environment variables psql reads the same parameters from, so that
+// a password in it isn't visible in psql's command line.
+func postgresEnviron(dsn string) ([]string, error) {
+	params := map[string]string{}
+	switch {
+	case strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://"):
+		// The authority is split out by hand, since it may list several hosts, which net/url
+		// doesn't accept.
+		rest := dsn[strings.Index(dsn, "://")+len("://"):]
+		authority := rest
+		if i := strings.IndexAny(rest, "/?"); i >= 0 {
+			authority, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		u, err := url.Parse("postgres://" + rest)
+		if err != nil {
+			return nil, err
+		}
+		if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+			userinfo := authority[:i]
+			authority = authority[i+1:]
+			user, pass, hasPass := userinfo, "", false
+			if j := strings.IndexByte(userinfo, ':'); j >= 0 {
+				user, pass, hasPass = userinfo[:j], userinfo[j+1:], true
+			}
+			if params["user"], err = url.PathUnescape(user); err != nil {
+				return nil, err
+			}
+			if hasPass {
+				if params["password"], err = url.PathUnescape(pass); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if authority != "" {
+			// Hosts may be a comma-separated list, each with an optional port.
+			var hosts, ports []string
+			for _, hostport := range strings.Split(authority, ",") {
+				host, port := hostport, ""
+				if i := strings.LastIndex(hostport, ":"); i >= 0 && !strings.HasSuffix(hostport, "]") {
+					host, port = hostport[:i], hostport[i+1:]
+				}
+				host, err := url.PathUnescape(strings.Trim(host, "[]")) // e.g., %2Frun%2Fpostgresql
+				if err != nil {
+					return nil, err
+				}
+				hosts = append(hosts, host)
+				ports = append(ports, port)
+			}
+			params["host"] = strings.Join(hosts, ",")
+			if strings.Join(ports, "") != "" {
+				params["port"] = strings.Join(ports, ",")
+			}
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			params["dbname"] = db
+		}
+		for key, values := range u.Query() {
+			params[key] = values[len(values)-1]
+		}
+	case strings.Contains(dsn, "="):
+		var err error
+		if params, err = parsePostgresParams(dsn); err != nil {
+			return nil, err
+		}
+	default:
+		params["dbname"] = dsn
+	}
+
+	env := make([]string, 0, len(params))
+	for key, value := range params {
+		name, ok := postgresEnvVars[key]
+		if !ok {
+			return nil, fmt.Errorf("unsupported connection parameter %q", key)
+		}
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// parsePostgresParams parses a libpq key=value connection string. Values may be single-quoted,
+// with backslash escapes.
+func parsePostgresParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t\n")
+
+		var value strings.Builder
+		quoted := strings.HasPrefix(s, "'")
+		if quoted {
+			s = s[1:]
+		}
+		for {
+			if s == "" {
+				if quoted {
+					return nil, fmt.Errorf("unterminated quoted value of %q in connection string", key)
+				}
+				break
+			}
+			c := s[0]
+			if c == '\\' && len(s) > 1 {
+				value.WriteByte(s[1])
+				s = s[2:]
+				continue
+			} else if quoted && c == '\'' {
+				s = s[1:]
+				break
+			} else if !quoted && (c == ' ' || c == '\t' || c == '\n') {
+				break
+			}
+			value.WriteByte(c)
+			s = s[1:]
+		}
+		params[key] = value.String()
+	}
+}
+
+// exportPostgres upserts the packages and manpages in Updates into the PostgreSQL database
+// described by env, as returned by postgresEnviron, using psql, in a single transaction. Rows for
+// packages and manpages no longer in the output tree are deleted. Titles, sections, and
+// descriptions are taken from metadata, if not nil. Details of packages not seen during this run
+// are left as they were.
+func (d *Dumper) exportPostgres(ctx context.Context, psql string, env []string, metadata *metadataIndex) error {
+	timer := Elapsed("elapsed")
+	Info(ctx, "Exporting to PostgreSQL")
+	defer func() { Info(ctx, "Finished exporting to PostgreSQL", timer()) }()
+
+	d.m.Lock()
+	keys := make([]string, 0, len(d.Updates))
+	updates := make(map[string][]string, len(d.Updates))
+	for key, paths := range d.Updates {
+		keys = append(keys, key)
+		updates[key] = paths
+	}
+	d.m.Unlock()
+	sort.Strings(keys)
+
+	var packages, pages [][]string
+	for _, key := range keys {
+		prov := d.packageProvenance(key)
+		packages = append(packages, []string{key, prov.Package, prov.Architecture, prov.Repository, prov.Maintainer})
+		for _, p := range updates[key] {
+			p = filepath.ToSlash(p)
+			var title, section, desc string
+			if meta := metadata.get(p); meta != nil {
+				title, section, desc = meta.Title, meta.Section, meta.Description
+			}
+			pages = append(pages, []string{p, key, title, section, desc})
+		}
+	}
+
+	var script strings.Builder
+	script.WriteString("BEGIN;\n")
+	script.WriteString(postgresSchema)
+	script.WriteString("CREATE TEMP TABLE new_packages (LIKE xmandump_packages) ON COMMIT DROP;\n")
+	script.WriteString("CREATE TEMP TABLE new_pages (LIKE xmandump_pages) ON COMMIT DROP;\n")
+	writeSQLInserts(&script, "new_packages", packages)
+	writeSQLInserts(&script, "new_pages", pages)
+	script.WriteString(`INSERT INTO xmandump_packages SELECT * FROM new_packages ON CONFLICT (cache_key) DO UPDATE SET
+	pkgver = COALESCE(EXCLUDED.pkgver, xmandump_packages.pkgver),
+	architecture = COALESCE(EXCLUDED.architecture, xmandump_packages.architecture),
+	repository = COALESCE(EXCLUDED.repository, xmandump_packages.repository),
+	maintainer = COALESCE(EXCLUDED.maintainer, xmandump_packages.maintainer);
+DELETE FROM xmandump_packages p WHERE NOT EXISTS (SELECT 1 FROM new_packages n WHERE n.cache_key = p.cache_key);
+INSERT INTO xmandump_pages SELECT * FROM new_pages ON CONFLICT (path, cache_key) DO UPDATE SET
+	title = EXCLUDED.title,
+	section = EXCLUDED.section,
+	description = EXCLUDED.description;
+DELETE FROM xmandump_pages p WHERE NOT EXISTS (SELECT 1 FROM new_pages n WHERE n.path = p.path AND n.cache_key = p.cache_key);
+COMMIT;
+`)
+
+	// The connection is only described by the environment, so it can't be seen in psql's arguments.
+	cmd := exec.Command(psql, "--no-psqlrc", "--quiet", "-v", "ON_ERROR_STOP=1", "-f", "-")
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(script.String())
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	Debug(ctx, "Running psql", zap.Int("packages", len(packages)), zap.Int("pages", len(pages)))
+	return cmd.Run()
+}
+
+// writeSQLInserts writes INSERT statements adding rows to table, in batches. Empty values are
+// inserted as NULL.
+func writeSQLInserts(w *strings.Builder, table string, rows [][]string) {
+	for start := 0; start < len(rows); start += postgresBatchSize {
+		end := start + postgresBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		fmt.Fprintf(w, "INSERT INTO %s VALUES\n", table)
+		for i, row := range rows[start:end] {
+			w.WriteString("(")
+			for j, v := range row {
+				if j > 0 {
+					w.WriteString(", ")
+				}
+				w.WriteString(sqlLiteral(v))
+			}
+			if i < end-start-1 {
+				w.WriteString("),\n")
+			} else {
+				w.WriteString(");\n")
+			}
+		}
+	}
+}
+
+// sqlLiteral quotes s as a standard SQL string literal, or NULL if s is empty. NUL bytes, which
+// PostgreSQL text cannot hold, are dropped.
+func sqlLiteral(s string) string {
+	if s == "" {
+		return "NULL"
+	}
+	s = strings.Replace(s, "\x00", "", -1)
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
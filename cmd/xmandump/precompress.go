@@ -0,0 +1,66 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/andybalholm/brotli"
+)
+
+// precompressSuffixes are the suffixes of the compressed copies written alongside each manpage
+// for static web servers (e.g., nginx's gzip_static and brotli_static).
+var precompressSuffixes = []string{".gz", ".br"}
+
+// precompressWriter compresses writes to a file, closing both when closed.
+type precompressWriter struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (p *precompressWriter) Close() error {
+	err := p.WriteCloser.Close()
+	if ferr := p.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// createPrecompressed creates the compressed copy of relpath with the given suffix, replacing any
+// existing file.
+func createPrecompressed(relpath, suffix string) (io.WriteCloser, error) {
+	if err := removeExisting(relpath + suffix); err != nil {
+		return nil, err
+	}
+	f, err := createNoFollow(relpath+suffix, 0666)
+	if err != nil {
+		return nil, err
+	}
+	var w io.WriteCloser
+	switch suffix {
+	case ".gz":
+		w, _ = gzip.NewWriterLevel(f, gzip.BestCompression)
+	case ".br":
+		w = brotli.NewWriterLevel(f, brotli.BestCompression)
+	}
+	return &precompressWriter{WriteCloser: w, f: f}, nil
+}
+
+// linkPrecompressed creates links from the compressed copies of relpath to the compressed copies
+// of lname, using link (os.Symlink or os.Link). Copies of lname that do not exist are skipped for
+// hard links. It returns the paths of the links created.
+func linkPrecompressed(lname, relpath string, link func(oldname, newname string) error) (paths []string, err error) {
+	for _, suffix := range precompressSuffixes {
+		if err := removeExisting(relpath + suffix); err != nil {
+			return paths, err
+		}
+		err := link(lname+suffix, relpath+suffix)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return paths, err
+		}
+		paths = append(paths, relpath+suffix)
+	}
+	return paths, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+)
+
+// packageProvenance describes a package that provides a manpage.
+type packageProvenance struct {
+	Package      string `json:"package,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	Repository   string `json:"repository,omitempty"`
+	Maintainer   string `json:"maintainer,omitempty"`
+	SHA256       string `json:"sha256"`
+}
+
+// pageProvenance describes where a manpage in the output tree came from.
+type pageProvenance struct {
+	Path string `json:"path"`
+	// Extracted is the time the page was last written, taken from its modification time.
+	Extracted *time.Time          `json:"extracted,omitempty"`
+	Providers []packageProvenance `json:"providers"`
+}
+
+// recordPackage records pkg as seen during this run so that its details can be looked up by its
+// cache key afterwards.
+func (d *Dumper) recordPackage(pkg *xrepo.Package) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.packages == nil {
+		d.packages = map[string]*xrepo.Package{}
+	}
+	d.packages[d.cacheKey(pkg)] = pkg
+}
+
+// pathProviders returns the SHA-256 of each package providing each path in Updates. The SHA-256s
+// of each path are sorted.
+func (d *Dumper) pathProviders() map[string][]string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	providers := map[string][]string{}
+	for sha, paths := range d.Updates {
+		for _, p := range paths {
+			p = filepath.ToSlash(p)
+			providers[p] = append(providers[p], sha)
+		}
+	}
+	for _, shas := range providers {
+		sort.Strings(shas)
+	}
+	return providers
+}
+
+// packageProvenance returns the provenance of the package with the given cache key (see cacheKey).
+// Packages not seen during this run, such as those kept from the cache without a repodata entry,
+// only have their SHA-256 set.
+func (d *Dumper) packageProvenance(sha string) packageProvenance {
+	d.m.Lock()
+	pkg := d.packages[sha]
+	d.m.Unlock()
+
+	prov := packageProvenance{SHA256: path.Base(sha)}
+	if pkg != nil {
+		prov.Package = pkg.PackageVersion
+		prov.Architecture = pkg.Architecture
+		prov.Repository = pkg.Repository
+		prov.Maintainer = pkg.Maintainer
+	}
+	return prov
+}
+
+// writeProvenance writes the provenance of every path in the output tree to file as a JSON array
+// sorted by path.
+func (d *Dumper) writeProvenance(file string) error {
+	providers := d.pathProviders()
+	pages := make([]pageProvenance, 0, len(providers))
+	for p, shas := range providers {
+		page := pageProvenance{Path: p}
+		if fi, err := os.Lstat(filepath.FromSlash(p)); err == nil {
+			mtime := fi.ModTime().UTC()
+			page.Extracted = &mtime
+		}
+		for _, sha := range shas {
+			page.Providers = append(page.Providers, d.packageProvenance(sha))
+		}
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+
+	p, err := json.Marshal(pages)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, p, 0644)
+}
+
+// packageName returns the pkgver of the package with the given SHA-256, or the SHA-256 itself if
+// the package was not seen during this run.
+func (d *Dumper) packageName(sha string) string {
+	if name := d.packageProvenance(sha).Package; name != "" {
+		return name
+	}
+	return sha
+}
+
+// writeReverseIndex writes a JSON object mapping each path in the output tree to the pkgvers of the
+// packages providing it.
+func (d *Dumper) writeReverseIndex(file string) error {
+	index := map[string][]string{}
+	for p, shas := range d.pathProviders() {
+		names := make([]string, 0, len(shas))
+		for _, sha := range shas {
+			names = append(names, d.packageName(sha))
+		}
+		sort.Strings(names)
+		index[p] = names
+	}
+
+	p, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, p, 0644)
+}
+
+// writeManifest writes a JSON object mapping the pkgver of each package to the manpages it
+// provides. Packages without manpages map to an empty list.
+func (d *Dumper) writeManifest(file string) error {
+	d.m.Lock()
+	shas := make(map[string][]string, len(d.Updates))
+	for sha, paths := range d.Updates {
+		shas[sha] = paths
+	}
+	d.m.Unlock()
+
+	manifest := map[string][]string{}
+	for sha, paths := range shas {
+		name := d.packageName(sha)
+		if manifest[name] == nil {
+			manifest[name] = []string{}
+		}
+		for _, p := range paths {
+			manifest[name] = append(manifest[name], filepath.ToSlash(p))
+		}
+	}
+	for name, paths := range manifest {
+		manifest[name] = rsyncPaths(paths)
+	}
+
+	p, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, p, 0644)
+}
+
+// packageRepos returns the repository of each package in Updates, for the cache. Repositories of
+// packages not seen during this run are taken from prev, the previous cache's repositories.
+func (d *Dumper) packageRepos(prev map[string]string) map[string]string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	repos := make(map[string]string, len(d.Updates))
+	for sha := range d.Updates {
+		if pkg := d.packages[sha]; pkg != nil {
+			if pkg.Repository != "" {
+				repos[sha] = pkg.Repository
+			}
+		} else if repo, ok := prev[sha]; ok {
+			repos[sha] = repo
+		}
+	}
+	return repos
+}
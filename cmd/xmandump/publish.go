@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+const publishTempSuffix = ".xmandump-publish"
+
+// publishTree mirrors files, the whole output tree, from the output directory into dest and removes
+// the files removed by the run from it, along with directories left empty. Files that are already
+// hardlinked into dest are left untouched, so publishing an unchanged tree is cheap, while a new or
+// drifted dest gets every file. New and changed files are hardlinked (or, for symlinks, recreated)
+// under a temporary name and renamed into place, so readers of dest never see a missing or partial
+// file.
+//
+// Because it uses hardlinks, dest must be on the same filesystem as the output directory.
+func publishTree(ctx context.Context, dest string, dirMode os.FileMode, files, removed []string) error {
+	ctx = WithFields(ctx, zap.String("publish", dest))
+
+	timer := Elapsed("elapsed")
+	Info(ctx, "Publishing output tree", zap.Int("files", len(files)), zap.Int("removals", len(removed)))
+	defer func() { Info(ctx, "Finished publishing output tree", timer()) }()
+
+	for _, file := range files {
+		if !isRelativeTreePath(file) {
+			Debug(ctx, "Skipping publish of unsafe file path", logFile(file))
+			continue
+		}
+		if err := publishFile(ctx, dest, dirMode, file); err != nil {
+			Error(ctx, "Unable to publish file", logFile(file), zap.Error(err))
+			return err
+		}
+	}
+
+	var unpublished []string
+	for _, file := range removed {
+		if !isRelativeTreePath(file) {
+			Debug(ctx, "Skipping removal of unsafe file path", logFile(file))
+			continue
+		}
+		p := filepath.Join(dest, file)
+		Debug(ctx, "Removing unpublished file", logFile(p))
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		unpublished = append(unpublished, file)
+	}
+
+	for _, dir := range parentDirs(unpublished) {
+		p := filepath.Join(dest, dir)
+		err := os.Remove(p)
+		if err == nil {
+			Debug(ctx, "Removed empty directory", logFile(p))
+		} else if !os.IsNotExist(err) && !isDirNotEmpty(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishFile links a single file from the output directory into dest.
+func publishFile(ctx context.Context, dest string, dirMode os.FileMode, file string) error {
+	src, err := os.Lstat(file)
+	if os.IsNotExist(err) {
+		Warn(ctx, "File to publish does not exist", logFile(file))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	target := filepath.Join(dest, file)
+	if err := os.MkdirAll(filepath.Dir(target), dirMode); err != nil {
+		return err
+	}
+
+	existing, err := os.Lstat(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp := target + publishTempSuffix
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if src.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(file)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.Mode()&os.ModeSymlink != 0 {
+			if old, err := os.Readlink(target); err == nil && old == link {
+				return nil
+			}
+		}
+		if err := os.Symlink(link, tmp); err != nil {
+			return err
+		}
+	} else {
+		if existing != nil && os.SameFile(src, existing) {
+			return nil
+		}
+		if err := os.Link(file, tmp); err != nil {
+			return err
+		}
+	}
+
+	Debug(ctx, "Publishing file", logFile(file))
+	return os.Rename(tmp, target)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// treeRemover removes files relative to a root directory file descriptor such that no file outside
+// of the root directory can be removed, even if a directory beneath the root is a symlink.
+type treeRemover struct {
+	root int
+}
+
+// openTreeRemover opens dir as the root of a treeRemover.
+func openTreeRemover(dir string) (*treeRemover, error) {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return &treeRemover{root: fd}, nil
+}
+
+// Remove removes file, a path relative to the root directory.
+func (t *treeRemover) Remove(file string) error {
+	return t.unlink(file, 0)
+}
+
+// RemoveDir removes dir, a path relative to the root directory, if it is empty.
+func (t *treeRemover) RemoveDir(dir string) error {
+	return t.unlink(dir, unix.AT_REMOVEDIR)
+}
+
+func (t *treeRemover) unlink(file string, flags int) error {
+	dir, base := filepath.Split(filepath.Clean(file))
+	dir = strings.TrimSuffix(dir, string(filepath.Separator))
+
+	dirfd := t.root
+	if dir != "" {
+		fd, err := t.openDir(dir)
+		if err != nil {
+			return &os.PathError{Op: "remove", Path: file, Err: err}
+		}
+		defer unix.Close(fd)
+		dirfd = fd
+	}
+
+	if err := unix.Unlinkat(dirfd, base, flags); err != nil {
+		return &os.PathError{Op: "remove", Path: file, Err: err}
+	}
+	return nil
+}
+
+// RemoveFiles removes files, paths relative to the root directory. Files are grouped by directory so
+// that each directory is opened once, and up to workers directories are processed concurrently.
+// done is called with each file and the error removing it, if any; calls to done are serialized.
+func (t *treeRemover) RemoveFiles(files []string, workers int, done func(file string, err error)) {
+	groups := map[string][]string{}
+	for _, file := range files {
+		dir, base := filepath.Split(filepath.Clean(file))
+		dir = strings.TrimSuffix(dir, string(filepath.Separator))
+		groups[dir] = append(groups[dir], base)
+	}
+	dirs := make([]string, 0, len(groups))
+	for dir := range groups {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var m sync.Mutex
+	report := func(file string, err error) {
+		if err != nil {
+			err = &os.PathError{Op: "remove", Path: file, Err: err}
+		}
+		m.Lock()
+		defer m.Unlock()
+		done(file, err)
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(dirs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range queue {
+				t.removeGroup(dir, groups[dir], report)
+			}
+		}()
+	}
+	for _, dir := range dirs {
+		queue <- dir
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// removeGroup removes the files named bases from dir, a path relative to the root directory.
+func (t *treeRemover) removeGroup(dir string, bases []string, report func(file string, err error)) {
+	dirfd := t.root
+	if dir != "" {
+		fd, err := t.openDir(dir)
+		if err != nil {
+			for _, base := range bases {
+				report(filepath.Join(dir, base), err)
+			}
+			return
+		}
+		defer unix.Close(fd)
+		dirfd = fd
+	}
+	for _, base := range bases {
+		report(filepath.Join(dir, base), unix.Unlinkat(dirfd, base, 0))
+	}
+}
+
+// parentDirs returns the directories containing files and their parents, excluding the root
+// directory, ordered so that each directory comes before its parent.
+func parentDirs(files []string) []string {
+	seen := map[string]struct{}{}
+	var dirs []string
+	for _, file := range files {
+		for dir := filepath.Dir(filepath.Clean(file)); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			if _, ok := seen[dir]; ok {
+				break
+			}
+			seen[dir] = struct{}{}
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := strings.Count(dirs[i], string(filepath.Separator)), strings.Count(dirs[j], string(filepath.Separator))
+		if di != dj {
+			return di > dj
+		}
+		return dirs[i] < dirs[j]
+	})
+	return dirs
+}
+
+// isDirNotEmpty returns whether err reports that a directory could not be removed because it is not
+// empty.
+func isDirNotEmpty(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == unix.ENOTEMPTY || err == unix.EEXIST
+}
+
+// openDirNoFollow opens dir, relative to the root directory, one component at a time without
+// following any symlinks.
+func (t *treeRemover) openDirNoFollow(dir string) (int, error) {
+	fd := t.root
+	for _, elem := range strings.Split(filepath.ToSlash(dir), "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+		if elem == ".." {
+			if fd != t.root {
+				unix.Close(fd)
+			}
+			return -1, unix.EXDEV
+		}
+		next, err := unix.Openat(fd, elem, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if fd != t.root {
+			unix.Close(fd)
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	if fd == t.root {
+		return unix.Dup(fd)
+	}
+	return fd, nil
+}
+
+// Close closes the root directory.
+func (t *treeRemover) Close() error {
+	return unix.Close(t.root)
+}
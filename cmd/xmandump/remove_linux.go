@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openat2 system call and constants. These are defined here because the vendored x/sys predates
+// openat2.
+const (
+	sysOpenat2 = 437
+
+	resolveNoMagiclinks = 0x02
+	resolveBeneath      = 0x08
+)
+
+type openHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+// openDir opens dir, relative to the root directory, using openat2 with RESOLVE_BENEATH so that
+// symlinks may not resolve to anything outside of the root. If openat2 is unavailable, it falls
+// back to openDirNoFollow. Seccomp profiles of container runtimes commonly deny openat2 with EPERM,
+// and older kernels may reject its resolve flags with EINVAL, so both are treated as unavailable.
+func (t *treeRemover) openDir(dir string) (int, error) {
+	path, err := unix.BytePtrFromString(dir)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: resolveBeneath | resolveNoMagiclinks,
+	}
+	fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(t.root), uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+	switch errno {
+	case 0:
+		return int(fd), nil
+	case unix.ENOSYS, unix.EPERM, unix.EINVAL:
+		return t.openDirNoFollow(dir)
+	default:
+		return -1, errno
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// openDir opens dir, relative to the root directory, without following symlinks.
+func (t *treeRemover) openDir(dir string) (int, error) {
+	return t.openDirNoFollow(dir)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+)
+
+// Layouts of the output tree when dumping more than one repository.
+const (
+	repoLayoutMerge = "merge"
+	repoLayoutSplit = "split"
+)
+
+// defaultRepoName is the name of the repository at the repository root, matching xrepo's default.
+const defaultRepoName = "current"
+
+// repoNames names the repository of each repodata file by its directory relative to root, so that
+// a repository has the same name however many others are dumped with it. For example, with a root
+// of current, current/x86_64-repodata and current/nonfree/x86_64-repodata are in the repositories
+// "current" and "nonfree". If root is empty, it returns nil, and every repository has xrepo's
+// default name. It is an error for a repodata file to be outside root.
+func repoNames(root string, files []string) (map[string]string, error) {
+	if root == "" {
+		return nil, nil
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string, len(files))
+	for _, file := range files {
+		dir, err := filepath.Abs(filepath.Dir(file))
+		if err != nil {
+			return nil, err
+		}
+		if !isWithinDir(root, dir) {
+			return nil, fmt.Errorf("repodata %s is not within repository root %s", file, root)
+		}
+		name, err := filepath.Rel(root, dir)
+		if err != nil {
+			return nil, err
+		} else if name == "." {
+			name = defaultRepoName
+		}
+		names[file] = filepath.ToSlash(name)
+	}
+	return names, nil
+}
+
+// isWithinDir returns whether path is dir or is beneath it.
+func isWithinDir(dir, path string) bool {
+	if dir == path || dir == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// repoDir returns the directory, relative to the output directory, that pkg's manpages are written
+// to. This is the package's repository if SplitRepos is set, and the output directory otherwise.
+func (d *Dumper) repoDir(pkg *xrepo.Package) string {
+	if !d.SplitRepos {
+		return ""
+	}
+	return filepath.FromSlash(pkg.Repository)
+}
+
+// cacheKey returns the key of pkg's entry in the cache. Packages are keyed by the SHA-256 of their
+// filename, qualified by their repository when repositories are split, since the same package file
+// may then be extracted once per repository.
+func (d *Dumper) cacheKey(pkg *xrepo.Package) string {
+	if !d.SplitRepos {
+		return pkg.FilenameSHA256
+	}
+	return pkg.Repository + "/" + pkg.FilenameSHA256
+}
+
+// repoRank returns the priority of repo, where lower ranks are higher priorities.
+func (d *Dumper) repoRank(repo string) int {
+	for i, r := range d.RepoPriority {
+		if r == repo {
+			return i
+		}
+	}
+	return len(d.RepoPriority)
+}
+
+// pathClaim records the highest-priority repository providing a manpage path when merging.
+type pathClaim struct {
+	rank    int
+	written bool // Whether the path was written during this run
+}
+
+// claimPath claims relpath for a manpage from repo, returning false if it has already been claimed
+// by a repository of higher priority. Paths are only claimed when merging repositories with
+// RepoPriority set.
+func (d *Dumper) claimPath(repo, relpath string) bool {
+	if d.SplitRepos || len(d.RepoPriority) == 0 {
+		return true
+	}
+	rank := d.repoRank(repo)
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.claims == nil {
+		d.claims = map[string]pathClaim{}
+	}
+	if c, ok := d.claims[relpath]; ok && c.rank < rank {
+		return false
+	}
+	d.claims[relpath] = pathClaim{rank: rank, written: true}
+	return true
+}
+
+// claimCached claims the paths of an already-dumped package from repo. It returns false if any
+// path was written during this run by a repository of lower priority, in which case the package
+// must be extracted again to restore its manpages.
+func (d *Dumper) claimCached(repo string, paths []string) bool {
+	if d.SplitRepos || len(d.RepoPriority) == 0 {
+		return true
+	}
+	rank := d.repoRank(repo)
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.claims == nil {
+		d.claims = map[string]pathClaim{}
+	}
+	ok := true
+	for _, p := range paths {
+		c, claimed := d.claims[p]
+		if !claimed || c.rank > rank {
+			if c.written {
+				ok = false
+			}
+			d.claims[p] = pathClaim{rank: rank}
+		}
+	}
+	return ok
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepoNames(t *testing.T) {
+	const (
+		current = "/srv/repo/current/x86_64-repodata"
+		nonfree = "/srv/repo/current/nonfree/x86_64-repodata"
+		multi   = "/srv/repo/current/multilib/nonfree/x86_64-repodata"
+	)
+	cases := []struct {
+		name  string
+		root  string
+		files []string
+		want  map[string]string // nil if every repository has the default name
+	}{
+		{"no root", "", []string{current, nonfree}, nil},
+		{"root only", "/srv/repo/current", []string{current}, map[string]string{current: "current"}},
+		{"single subrepository", "/srv/repo/current", []string{nonfree}, map[string]string{nonfree: "nonfree"}},
+		{
+			"several repositories",
+			"/srv/repo/current",
+			[]string{current, nonfree, multi},
+			map[string]string{current: "current", nonfree: "nonfree", multi: "multilib/nonfree"},
+		},
+		{"root with trailing slash", "/srv/repo/current/", []string{nonfree}, map[string]string{nonfree: "nonfree"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := repoNames(filepath.FromSlash(c.root), c.files)
+			if err != nil {
+				t.Fatalf("repoNames(%q, %q): %v", c.root, c.files, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("repoNames(%q, %q) = %v; want %v", c.root, c.files, got, c.want)
+			}
+		})
+	}
+
+	if _, err := repoNames("/srv/repo/current", []string{"/srv/other/x86_64-repodata"}); err == nil {
+		t.Error("repoNames with repodata outside the root succeeded; want error")
+	}
+}
+
+// A repository's name must not depend on which other repositories are dumped in the same run, since
+// it decides the output directory and cache keys of its packages.
+func TestRepoNamesStable(t *testing.T) {
+	const (
+		root    = "/srv/repo/current"
+		current = root + "/x86_64-repodata"
+		nonfree = root + "/nonfree/x86_64-repodata"
+	)
+	alone, err := repoNames(root, []string{nonfree})
+	if err != nil {
+		t.Fatal(err)
+	}
+	together, err := repoNames(root, []string{current, nonfree})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alone[nonfree] != together[nonfree] {
+		t.Errorf("repository named %q alone but %q with %s", alone[nonfree], together[nonfree], current)
+	}
+}
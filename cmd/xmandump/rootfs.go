@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/void-linux/xmandump/internal/nxtools/xrepo"
+
+	"go.uber.org/zap"
+)
+
+// rootfsPackage returns the package that manpages dumped from the root filesystem at root are
+// recorded as in the cache.
+func rootfsPackage(root string) *xrepo.Package {
+	return &xrepo.Package{
+		PackageVersion: "rootfs",
+		Name:           "rootfs",
+		FilenameSHA256: "rootfs:" + root,
+	}
+}
+
+// processRootfs dumps the manpages installed beneath the root filesystem at root, such as an
+// installed system or an unpacked container image, as though they all came from a single package.
+// Unlike packages, they are always written again, since there is no version to compare against the
+// cache.
+func (d *Dumper) processRootfs(ctx context.Context, root string) error {
+	ctx = WithFields(ctx, zap.String("rootfs", root))
+	pkg := rootfsPackage(root)
+	d.recordPackage(pkg)
+
+	Info(ctx, "Processing root filesystem")
+	timer := Elapsed("elapsed")
+	defer func() { Info(ctx, "Finished processing root filesystem", timer()) }()
+
+	seen := map[string]struct{}{}
+	mandir := filepath.Join(root, filepath.FromSlash(manPathTrimPrefix))
+	err := filepath.Walk(mandir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = "./" + filepath.ToSlash(rel)
+
+		var r io.Reader
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer logClose(ctx, f)
+			r = f
+		}
+
+		if err := d.processPackageFile(ctx, pkg, hdr, r, seen); err != nil {
+			Error(ctx, "Error processing root filesystem file", logPkgFile(hdr.Name), zap.Error(err))
+			return err
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		Warn(ctx, "Root filesystem has no manpages", logFile(mandir))
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// writeRsyncFilesFrom writes the given paths, one per line, to file. The result is suitable for use
+// with rsync's --files-from option from the output directory.
+func writeRsyncFilesFrom(file string, changed []string) error {
+	paths := rsyncPaths(changed)
+	var buf bytes.Buffer
+	for _, p := range paths {
+		buf.WriteString(p)
+		buf.WriteByte('\n')
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+// writeRsyncFilter writes an rsync filter file to file that includes only changed and removed paths
+// (and their parent directories) and excludes everything else. Used with --delete, this allows rsync
+// to transfer new files and delete removed files without walking the whole output tree.
+func writeRsyncFilter(file string, changed, removed []string) error {
+	paths := rsyncPaths(append(append([]string(nil), changed...), removed...))
+	dirs := map[string]struct{}{}
+	var buf bytes.Buffer
+	for _, p := range paths {
+		for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, ok := dirs[dir]; ok {
+				break
+			}
+			dirs[dir] = struct{}{}
+		}
+	}
+
+	dirList := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		dirList = append(dirList, dir)
+	}
+	sort.Strings(dirList)
+
+	for _, dir := range dirList {
+		buf.WriteString("+ /" + dir + "/\n")
+	}
+	for _, p := range paths {
+		buf.WriteString("+ /" + p + "\n")
+	}
+	buf.WriteString("- *\n")
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+// rsyncPaths returns a sorted, deduplicated list of slash-separated paths.
+func rsyncPaths(files []string) []string {
+	seen := make(map[string]struct{}, len(files))
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		p := filepath.ToSlash(file)
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
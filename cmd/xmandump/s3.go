@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// s3Uploads is the number of concurrent requests made to object storage.
+const s3Uploads = 8
+
+// s3Bucket is an S3-compatible bucket that the output tree is mirrored to. Requests are signed with
+// AWS Signature Version 4 and use path-style URLs, which all S3-compatible services accept.
+type s3Bucket struct {
+	Endpoint *url.URL
+	Bucket   string
+	Prefix   string // Prepended to each key, e.g. "x86_64/"
+	Region   string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	Client *http.Client
+}
+
+// newS3Bucket returns a bucket at endpoint using credentials from the standard AWS environment
+// variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and optionally AWS_SESSION_TOKEN).
+func newS3Bucket(endpoint, bucket, prefix, region string) (*s3Bucket, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q: must be an http or https URL", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket given")
+	}
+	b := &s3Bucket{
+		Endpoint:     u,
+		Bucket:       bucket,
+		Prefix:       prefix,
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Client:       &http.Client{Timeout: 5 * time.Minute},
+	}
+	if b.AccessKey == "" || b.SecretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return b, nil
+}
+
+// sync uploads files from the output tree in the current directory and deletes the objects of
+// removed files. Symlinks are uploaded as copies of their targets, since object storage has no
+// links, and dangling symlinks are skipped.
+func (b *s3Bucket) sync(ctx context.Context, files, removed []string) error {
+	ctx = WithFields(ctx, zap.String("bucket", b.Bucket), zap.String("prefix", b.Prefix))
+
+	timer := Elapsed("elapsed")
+	Info(ctx, "Syncing output tree to object storage", zap.Int("uploads", len(files)), zap.Int("deletions", len(removed)))
+	defer func() { Info(ctx, "Finished syncing output tree to object storage", timer()) }()
+
+	sema := semaphore.NewWeighted(s3Uploads)
+	wg, ctx := errgroup.WithContext(ctx)
+	each := func(paths []string, fn func(context.Context, string) error) {
+		done := make(map[string]struct{}, len(paths))
+		for _, p := range paths {
+			p := p
+			if _, ok := done[p]; ok {
+				continue
+			}
+			done[p] = struct{}{}
+			if !isRelativeTreePath(p) {
+				Debug(ctx, "Skipping sync of unsafe file path", logFile(p))
+				continue
+			}
+			if err := sema.Acquire(ctx, 1); err != nil {
+				return
+			}
+			wg.Go(func() error {
+				defer sema.Release(1)
+				if err := fn(ctx, p); err != nil {
+					Error(ctx, "Unable to sync file to object storage", logFile(p), zap.Error(err))
+					return err
+				}
+				return nil
+			})
+		}
+	}
+	each(files, b.put)
+	each(removed, b.delete)
+	return wg.Wait()
+}
+
+// put uploads the file at relpath. If relpath is a dangling symlink, nothing is uploaded.
+func (b *s3Bucket) put(ctx context.Context, relpath string) error {
+	body, err := ioutil.ReadFile(relpath)
+	if os.IsNotExist(err) {
+		if fi, lerr := os.Lstat(relpath); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			Warn(ctx, "Skipping sync of dangling symlink", logFile(relpath))
+			return nil
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(path.Ext(relpath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := http.Header{"Content-Type": {contentType}}
+	return b.do(ctx, http.MethodPut, relpath, header, body)
+}
+
+// delete deletes the object of the file at relpath. Deleting an object that doesn't exist succeeds.
+func (b *s3Bucket) delete(ctx context.Context, relpath string) error {
+	return b.do(ctx, http.MethodDelete, relpath, http.Header{}, nil)
+}
+
+func (b *s3Bucket) do(ctx context.Context, method, relpath string, header http.Header, body []byte) error {
+	key := b.Prefix + filepath.ToSlash(relpath)
+	u := *b.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.Bucket + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header
+	if b.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.SessionToken)
+	}
+	b.sign(req, body, time.Now())
+
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sign signs req with AWS Signature Version 4, covering the host and every header already set on
+// req.
+func (b *s3Bucket) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretKey), date)
+	for _, part := range []string{b.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3EscapePath escapes p as required for S3 signatures: everything but unreserved characters and
+// slashes is percent-encoded.
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) != -1 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
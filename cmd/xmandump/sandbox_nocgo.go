@@ -0,0 +1,8 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+// cgoEnabled is whether the binary links cgo. Go cannot apply a sandbox to all threads of a
+// process that links cgo.
+const cgoEnabled = false
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// enterSandbox is not supported on this platform.
+func enterSandbox(writable []string, refer bool) error {
+	return errors.New("sandboxing is only supported on Linux")
+}
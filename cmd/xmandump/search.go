@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Search services that manpages can be indexed in.
+const (
+	searchEngineMeilisearch   = "meilisearch"
+	searchEngineElasticsearch = "elasticsearch"
+)
+
+// searchBatchSize is the number of documents sent to the search service per request.
+const searchBatchSize = 500
+
+// searchIndex is an index on a Meilisearch or Elasticsearch server that manpages are pushed to.
+// Only pages written or removed by a run are sent, so the index is kept in sync incrementally.
+type searchIndex struct {
+	Engine string
+	URL    *url.URL
+	Index  string
+	Key    string // API key, sent as a bearer token (Meilisearch) or ApiKey (Elasticsearch)
+
+	Client *http.Client
+}
+
+// searchDocument is the document indexed for a single manpage.
+type searchDocument struct {
+	ID          string   `json:"id"`
+	Page        string   `json:"page"` // Section and page, e.g. "1/foo.1"
+	Path        string   `json:"path"`
+	Package     string   `json:"package,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Section     string   `json:"section,omitempty"`
+	Names       []string `json:"names,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Content     string   `json:"content,omitempty"`
+}
+
+// newSearchIndex returns the index named index on the search service at rawurl. The API key, if
+// any, is read from XMANDUMP_SEARCH_KEY.
+func newSearchIndex(engine, rawurl, index string) (*searchIndex, error) {
+	if engine != searchEngineMeilisearch && engine != searchEngineElasticsearch {
+		return nil, fmt.Errorf("invalid search engine %q: must be %s or %s", engine, searchEngineMeilisearch, searchEngineElasticsearch)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid search URL %q: must be an http or https URL", rawurl)
+	}
+	if index == "" {
+		return nil, fmt.Errorf("no search index given")
+	}
+	return &searchIndex{
+		Engine: engine,
+		URL:    u,
+		Index:  index,
+		Key:    os.Getenv("XMANDUMP_SEARCH_KEY"),
+		Client: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// searchDocumentID returns the document ID of the manpage with the given section/page key. IDs are
+// hashed, since Meilisearch only accepts alphanumeric characters, hyphens, and underscores.
+func searchDocumentID(page string) string {
+	return sha256Hex([]byte(page))[:32]
+}
+
+// sync indexes the manpages among files and deletes the documents of manpages among removed, using
+// metadata for titles and descriptions if it is not nil. Content is taken from a page's text
+// rendition if there is one, and from its source otherwise.
+func (s *searchIndex) sync(ctx context.Context, files, removed []string, metadata *metadataIndex) error {
+	ctx = WithFields(ctx, zap.String("search_engine", s.Engine), zap.String("search_index", s.Index))
+
+	docs := map[string]*searchDocument{}
+	for _, p := range files {
+		p = filepath.ToSlash(p)
+		page := servedPageKey(p)
+		if page == "" || !isRelativeTreePath(p) {
+			continue
+		} else if _, ok := docs[page]; ok {
+			continue
+		}
+		doc, err := readSearchDocument(ctx, p, page, metadata)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			Warn(ctx, "Unable to read manpage for search index", logFile(p), zap.Error(err))
+			continue
+		}
+		docs[page] = doc
+	}
+
+	var deletes []string
+	seen := map[string]struct{}{}
+	for _, p := range removed {
+		page := servedPageKey(filepath.ToSlash(p))
+		if page == "" {
+			continue
+		} else if _, ok := docs[page]; ok {
+			continue
+		} else if _, ok := seen[page]; ok {
+			continue
+		}
+		seen[page] = struct{}{}
+		deletes = append(deletes, searchDocumentID(page))
+	}
+	sort.Strings(deletes)
+
+	pages := make([]string, 0, len(docs))
+	for page := range docs {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	timer := Elapsed("elapsed")
+	Info(ctx, "Syncing search index", zap.Int("documents", len(pages)), zap.Int("deletions", len(deletes)))
+	defer func() { Info(ctx, "Finished syncing search index", timer()) }()
+
+	for start := 0; start < len(pages); start += searchBatchSize {
+		end := start + searchBatchSize
+		if end > len(pages) {
+			end = len(pages)
+		}
+		batch := make([]*searchDocument, 0, end-start)
+		for _, page := range pages[start:end] {
+			batch = append(batch, docs[page])
+		}
+		if err := s.put(ctx, batch); err != nil {
+			return err
+		}
+	}
+	for start := 0; start < len(deletes); start += searchBatchSize {
+		end := start + searchBatchSize
+		if end > len(deletes) {
+			end = len(deletes)
+		}
+		if err := s.delete(ctx, deletes[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSearchDocument returns the search document of the manpage at p.
+func readSearchDocument(ctx context.Context, p, page string, metadata *metadataIndex) (*searchDocument, error) {
+	content, err := ioutil.ReadFile(textPath(p))
+	if os.IsNotExist(err) {
+		content, err = readPageSource(ctx, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Links are indexed with the metadata of their targets, but keep the package they came from.
+	meta := metadata.get(p)
+	if meta == nil || meta.Link != "" {
+		pkg := ""
+		if meta != nil {
+			pkg = meta.Package
+		}
+		if meta, err = readPageMeta(ctx, p); err != nil {
+			return nil, err
+		}
+		meta.Package = pkg
+	}
+	return &searchDocument{
+		ID:          searchDocumentID(page),
+		Page:        page,
+		Path:        p,
+		Package:     meta.Package,
+		Title:       meta.Title,
+		Section:     meta.Section,
+		Names:       meta.Names,
+		Description: meta.Description,
+		Content:     string(bytes.ToValidUTF8(content, nil)),
+	}, nil
+}
+
+// readPageSource returns up to maxPageParseSize bytes of the manpage at relpath, decompressed.
+func readPageSource(ctx context.Context, relpath string) ([]byte, error) {
+	f, err := os.Open(relpath)
+	if err != nil {
+		return nil, err
+	}
+	defer logClose(ctx, f)
+
+	r, err := newPageDecompressor(pageCompression(relpath), f)
+	if err != nil {
+		return nil, err
+	}
+	defer logClose(ctx, r)
+	return ioutil.ReadAll(io.LimitReader(r, maxPageParseSize))
+}
+
+// put adds or replaces docs in the index.
+func (s *searchIndex) put(ctx context.Context, docs []*searchDocument) error {
+	if s.Engine == searchEngineMeilisearch {
+		body, err := json.Marshal(docs)
+		if err != nil {
+			return err
+		}
+		return s.do(ctx, "indexes/"+url.PathEscape(s.Index)+"/documents?primaryKey=id", "application/json", body)
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, doc := range docs {
+		action := map[string]interface{}{"index": map[string]string{"_id": doc.ID}}
+		if err := enc.Encode(action); err != nil {
+			return err
+		} else if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return s.do(ctx, url.PathEscape(s.Index)+"/_bulk", "application/x-ndjson", body.Bytes())
+}
+
+// delete removes the documents with the given IDs from the index. Deleting a document that doesn't
+// exist succeeds.
+func (s *searchIndex) delete(ctx context.Context, ids []string) error {
+	if s.Engine == searchEngineMeilisearch {
+		body, err := json.Marshal(ids)
+		if err != nil {
+			return err
+		}
+		return s.do(ctx, "indexes/"+url.PathEscape(s.Index)+"/documents/delete-batch", "application/json", body)
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, id := range ids {
+		action := map[string]interface{}{"delete": map[string]string{"_id": id}}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+	}
+	return s.do(ctx, url.PathEscape(s.Index)+"/_bulk", "application/x-ndjson", body.Bytes())
+}
+
+// do POSTs body to the given path under the service URL. Elasticsearch bulk responses are checked
+// for per-document errors, which are otherwise reported with a successful status.
+func (s *searchIndex) do(ctx context.Context, rel, contentType string, body []byte) error {
+	ref, err := url.Parse(rel)
+	if err != nil {
+		return err
+	}
+	u := *s.URL
+	u.Path = path.Join("/", u.Path, ref.Path)
+	u.RawPath = ""
+	u.RawQuery = ref.RawQuery
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if s.Key != "" {
+		scheme := "Bearer"
+		if s.Engine == searchEngineElasticsearch {
+			scheme = "ApiKey"
+		}
+		req.Header.Set("Authorization", scheme+" "+s.Key)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, u.Path, resp.Status, bytes.TrimSpace(p))
+	}
+	if s.Engine == searchEngineElasticsearch {
+		var bulk struct {
+			Errors bool `json:"errors"`
+		}
+		if err := json.Unmarshal(p, &bulk); err == nil && bulk.Errors {
+			return fmt.Errorf("%s %s: bulk request reported errors: %s", req.Method, u.Path, bytes.TrimSpace(p))
+		}
+	}
+	return nil
+}
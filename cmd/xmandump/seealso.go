@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// seeAlsoEdge is a reference from the SEE ALSO section of one manpage to another.
+type seeAlsoEdge struct {
+	From string `json:"from"`
+	Ref  string `json:"ref"`
+	// To is the path of the referenced manpage. It is empty if the reference is dangling.
+	To string `json:"to,omitempty"`
+}
+
+// seeAlsoGraph is the cross-reference graph of a manpage tree.
+type seeAlsoGraph struct {
+	Edges    []seeAlsoEdge `json:"edges"`
+	Dangling int           `json:"dangling"`
+}
+
+// writeSeeAlsoGraph writes the SEE ALSO graph of pages to file. References are resolved by the
+// names and sections of manpage files first and then by the names in each page's NAME section.
+func writeSeeAlsoGraph(file string, pages []*pageMeta) error {
+	refs := map[string]string{}
+	for _, page := range pages {
+		if ref := pathRef(page.Path); ref != "" {
+			refs[strings.ToLower(ref)] = page.Path
+		}
+	}
+	for _, page := range pages {
+		if page.Section == "" {
+			continue
+		}
+		for _, name := range page.Names {
+			ref := strings.ToLower(name + "(" + page.Section + ")")
+			if _, ok := refs[ref]; !ok {
+				refs[ref] = page.Path
+			}
+		}
+	}
+
+	graph := seeAlsoGraph{Edges: []seeAlsoEdge{}}
+	for _, page := range pages {
+		for _, ref := range page.SeeAlso {
+			edge := seeAlsoEdge{From: page.Path, Ref: ref, To: refs[strings.ToLower(ref)]}
+			if edge.To == "" {
+				graph.Dangling++
+			}
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+
+	p, err := json.Marshal(graph)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, p, 0644)
+}
+
+// pathRef returns the manpage reference, e.g. "foo(1)", for a manpage path such as man1/foo.1.gz.
+func pathRef(p string) string {
+	base := trimPageCompression(path.Base(p))
+	dot := strings.LastIndexByte(base, '.')
+	if dot <= 0 || dot == len(base)-1 {
+		return ""
+	}
+	return base[:dot] + "(" + base[dot+1:] + ")"
+}
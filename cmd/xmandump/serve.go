@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func init() {
+	subcommands["serve"] = &subcommand{
+		Usage: "serve [-addr host:port] [-repo-root dir] -c cache repodata... -- serve a JSON API mapping packages to manpages",
+		Run:   runServe,
+	}
+}
+
+// servedPackage is a package as reported by GET /pkg/<name>.
+type servedPackage struct {
+	Package      string   `json:"package"`
+	Architecture string   `json:"architecture,omitempty"`
+	Repository   string   `json:"repository,omitempty"`
+	Pages        []string `json:"pages"`
+}
+
+// servedPage is a manpage as reported by GET /man/<section>/<page>.
+type servedPage struct {
+	Path     string   `json:"path"`
+	Packages []string `json:"packages"`
+}
+
+// Timeouts of the API server.
+const (
+	serveReadTimeout     = 10 * time.Second
+	serveWriteTimeout    = 30 * time.Second
+	serveIdleTimeout     = 2 * time.Minute
+	serveShutdownTimeout = 10 * time.Second
+)
+
+// serveIndex maps packages to manpages and back, as recorded in a cache file. It is rebuilt
+// whenever the cache file changes. Requests are served from the current index while it is rebuilt.
+type serveIndex struct {
+	cacheFile string
+	repodata  []string
+	repoNames map[string]string // Names of the repositories of repodata files
+
+	rebuilding int32 // atomic; non-zero while a request is rebuilding the index
+
+	m        sync.Mutex
+	modTime  time.Time                  // Of the cache file last loaded, or last failed to load
+	packages map[string][]servedPackage // By package name
+	pages    map[string][]servedPage    // By section/page, with and without the page's extension
+}
+
+func runServe(args []string) int {
+	var (
+		flagLevel = zap.WarnLevel
+		addr      = "localhost:8080"
+		cacheFile string
+		repoRoot  string
+	)
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Var(&flagLevel, "v", "log level")
+	fs.StringVar(&addr, "addr", addr, "address to listen on")
+	fs.StringVar(&cacheFile, "c", "", "cache file")
+	fs.StringVar(&repoRoot, "repo-root", "", "directory that repositories are named relative to, as when dumping")
+	_ = fs.Parse(args)
+
+	if cacheFile == "" {
+		return fatalf("no cache file given (-c)")
+	}
+	names, err := repoNames(repoRoot, fs.Args())
+	if err != nil {
+		return fatalf("invalid -repo-root: %v", err)
+	}
+
+	logger, err := NewLogger(zap.NewAtomicLevelAt(flagLevel))
+	if err != nil {
+		return fatalf("unable to create logger: %v", err)
+	}
+	ctx := WithLogger(context.Background(), logger)
+
+	idx := &serveIndex{cacheFile: cacheFile, repodata: fs.Args(), repoNames: names}
+	if err := idx.reload(ctx); err != nil {
+		return fatalf("unable to load cache: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pkg/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/pkg/")
+		idx.serve(ctx, w, func() (interface{}, bool) {
+			pkgs, ok := idx.packages[name]
+			return pkgs, ok
+		})
+	})
+	mux.HandleFunc("/man/", func(w http.ResponseWriter, r *http.Request) {
+		page := strings.TrimPrefix(r.URL.Path, "/man/")
+		idx.serve(ctx, w, func() (interface{}, bool) {
+			pages, ok := idx.pages[page]
+			return pages, ok
+		})
+	})
+
+	// Stop serving on SIGINT or SIGTERM, letting requests in progress finish.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  serveReadTimeout,
+		WriteTimeout: serveWriteTimeout,
+		IdleTimeout:  serveIdleTimeout,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	logger.Info("Serving API", zap.String("addr", addr))
+
+	select {
+	case err := <-errc:
+		return fatalf("%v", err)
+	case <-ctx.Done():
+	}
+	logger.Info("Shutting down API server")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fatalf("unable to shut down server: %v", err)
+	}
+	return 0
+}
+
+// serve writes the result of lookup as JSON, reloading the index first if the cache file has
+// changed. It responds 404 if lookup finds nothing.
+func (idx *serveIndex) serve(ctx context.Context, w http.ResponseWriter, lookup func() (interface{}, bool)) {
+	if err := idx.reload(ctx); err != nil {
+		Error(ctx, "Unable to reload cache", logFile(idx.cacheFile), zap.Error(err))
+	}
+
+	idx.m.Lock()
+	v, ok := lookup()
+	idx.m.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		v = map[string]string{"error": "not found"}
+	}
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// reload rebuilds the index from the cache file and repodata if the cache file has been modified
+// since it was last loaded. The index is built without holding the lock, and requests arriving
+// while it is rebuilt are served from the current index. If it can't be rebuilt, it isn't tried
+// again until the cache file changes.
+func (idx *serveIndex) reload(ctx context.Context) error {
+	fi, err := os.Stat(idx.cacheFile)
+	if err != nil {
+		return err
+	}
+	idx.m.Lock()
+	current := fi.ModTime().Equal(idx.modTime)
+	idx.m.Unlock()
+	if current || !atomic.CompareAndSwapInt32(&idx.rebuilding, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&idx.rebuilding, 0)
+
+	packages, pages, err := buildServeIndex(ctx, idx.cacheFile, idx.repodata, idx.repoNames)
+
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	idx.modTime = fi.ModTime()
+	if err != nil {
+		return err
+	}
+	idx.packages = packages
+	idx.pages = pages
+	Info(ctx, "Loaded cache", logFile(idx.cacheFile), zap.Int("packages", len(packages)), zap.Int("pages", len(pages)))
+	return nil
+}
+
+// buildServeIndex builds the package and page maps of a serveIndex from a cache file and repodata,
+// whose repositories are named by names.
+func buildServeIndex(ctx context.Context, cacheFile string, repodata []string, names map[string]string) (map[string][]servedPackage, map[string][]servedPage, error) {
+	var cache cacheRecords
+	p, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(p, &cache); err != nil {
+		return nil, nil, err
+	}
+
+	// Packages can be keyed by either of their cache keys, depending on the repository layout.
+	d := &Dumper{RepoNames: names}
+	type pkgInfo struct{ pkgver, name, arch, repo string }
+	byKey := map[string]pkgInfo{}
+	for _, file := range repodata {
+		rd, err := d.readRepoData(ctx, file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, pkg := range rd.Index() {
+			info := pkgInfo{pkg.PackageVersion, pkg.Name, pkg.Architecture, pkg.Repository}
+			byKey[pkg.FilenameSHA256] = info
+			byKey[pkg.Repository+"/"+pkg.FilenameSHA256] = info
+		}
+	}
+
+	packages := map[string][]servedPackage{}
+	pageProviders := map[string]map[string]struct{}{}
+	for key, paths := range cache.Cache {
+		info, ok := byKey[key]
+		if !ok {
+			// Not in the given repodata -- identify it by its cache key alone.
+			info = pkgInfo{pkgver: key, name: key}
+		}
+		pkg := servedPackage{Package: info.pkgver, Architecture: info.arch, Repository: info.repo}
+		own := make(map[string]struct{}, len(paths))
+		for _, p := range paths {
+			own[filepath.ToSlash(p)] = struct{}{}
+		}
+		for _, p := range paths {
+			p = filepath.ToSlash(p)
+			if servedPageKey(p) == "" {
+				continue
+			}
+			if _, ok := own[trimPageCompression(p)]; ok && trimPageCompression(p) != p {
+				// Precompressed copy of a page
+				continue
+			}
+			pkg.Pages = append(pkg.Pages, p)
+			if pageProviders[p] == nil {
+				pageProviders[p] = map[string]struct{}{}
+			}
+			pageProviders[p][info.pkgver] = struct{}{}
+		}
+		sort.Strings(pkg.Pages)
+		packages[info.name] = append(packages[info.name], pkg)
+	}
+
+	pages := map[string][]servedPage{}
+	for p, providers := range pageProviders {
+		page := servedPage{Path: p, Packages: sortedKeys(providers)}
+		key := servedPageKey(p)
+		pages[key] = append(pages[key], page)
+		if ext := path.Ext(key); ext != "" {
+			pages[strings.TrimSuffix(key, ext)] = append(pages[strings.TrimSuffix(key, ext)], page)
+		}
+	}
+	for _, list := range pages {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+
+	return packages, pages, nil
+}
+
+// servedPageKey returns the section/page key of the manpage at p (e.g., 1/foo.1 for man1/foo.1.gz),
+// or an empty string if p is not a manpage, such as a text rendition or precompressed copy.
+func servedPageKey(p string) string {
+	dir := path.Base(path.Dir(p))
+	if !strings.HasPrefix(dir, "man") || len(dir) == len("man") {
+		return ""
+	}
+	base := path.Base(p)
+	if strings.HasSuffix(base, textSuffix) || strings.HasSuffix(base, ".br") {
+		return ""
+	}
+	return dir[len("man"):] + "/" + trimPageCompression(base)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// shareTempSuffix is the suffix of the temporary link used to replace a file with a link to an
+// identical file in another output tree.
+const shareTempSuffix = ".xmandump-share"
+
+// shareFile replaces the file at relpath with a link to the file at the same path under dir, the
+// root of another output tree (e.g., the glibc tree when writing the musl one), if both have
+// identical content. Links are hard links unless symlink is true, in which case they are absolute
+// symlinks. It returns whether the file was replaced.
+func shareFile(ctx context.Context, dir, relpath string, symlink bool) (bool, error) {
+	fi, err := os.Lstat(relpath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false, err
+	}
+
+	other := filepath.Join(dir, relpath)
+	ofi, err := os.Lstat(other)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !ofi.Mode().IsRegular() || ofi.Size() != fi.Size() || os.SameFile(fi, ofi) {
+		return false, nil
+	}
+
+	same, err := sameContent(relpath, other)
+	if !same || err != nil {
+		return false, err
+	}
+
+	tmp := relpath + shareTempSuffix
+	if err := removeExisting(tmp); err != nil {
+		return false, err
+	}
+	if symlink {
+		err = os.Symlink(other, tmp)
+	} else {
+		err = os.Link(other, tmp)
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, relpath); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	Debug(ctx, "Linked file to identical file in shared tree", zap.String("shared", other))
+	return true, nil
+}
+
+// sameContent returns whether the files at a and b have identical content.
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufa, bufb := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, erra := io.ReadFull(fa, bufa)
+		nb, errb := io.ReadFull(fb, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			return errb == erra, nil
+		} else if erra != nil {
+			return false, erra
+		} else if errb != nil {
+			return false, errb
+		}
+	}
+}
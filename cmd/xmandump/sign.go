@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"go.uber.org/zap"
+)
+
+// Supported signing tools.
+const (
+	signToolSignify  = "signify"
+	signToolMinisign = "minisign"
+)
+
+// validSignTool returns whether tool is a supported signing tool.
+func validSignTool(tool string) bool {
+	return tool == signToolSignify || tool == signToolMinisign
+}
+
+// signFile signs file with the secret key at key using the given tool. The signature is written
+// next to file (file.sig for signify, file.minisig for minisign). If the key is encrypted, the tool
+// prompts for its passphrase on the terminal.
+func signFile(ctx context.Context, tool, key, file string) error {
+	ctx = WithFields(ctx, logFile(file), zap.String("tool", tool))
+
+	var sigfile string
+	switch tool {
+	case signToolSignify:
+		sigfile = file + ".sig"
+	case signToolMinisign:
+		sigfile = file + ".minisig"
+	default:
+		return fmt.Errorf("unsupported signing tool: %s", tool)
+	}
+
+	Debug(ctx, "Signing file", zap.String("signature", sigfile))
+	cmd := exec.Command(tool, "-S", "-s", key, "-m", file, "-x", sigfile)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// maxSitemapURLs is the maximum number of URLs in a single sitemap file.
+const maxSitemapURLs = 50000
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapLoc `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// writeSitemap writes sitemap.xml listing the manpages in files (slash-separated paths in the
+// output tree) under baseURL. If there are more manpages than fit in one sitemap, they are split
+// across sitemap-1.xml, sitemap-2.xml, and so on, and sitemap.xml is written as a sitemap index.
+// It returns the paths written.
+func writeSitemap(baseURL string, files []string) ([]string, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(p string) string {
+		return base.ResolveReference(&url.URL{Path: p}).String()
+	}
+
+	pages := indexPages(files)
+	var chunks [][]string
+	for len(pages) > maxSitemapURLs {
+		chunks = append(chunks, pages[:maxSitemapURLs])
+		pages = pages[maxSitemapURLs:]
+	}
+	chunks = append(chunks, pages)
+
+	var written []string
+	write := func(file string, v interface{}) error {
+		p, err := xml.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeTreeFile(file, append([]byte(xml.Header), append(p, '\n')...)); err != nil {
+			return err
+		}
+		written = append(written, file)
+		return nil
+	}
+
+	urlSet := func(chunk []string) sitemapURLSet {
+		set := sitemapURLSet{XMLNS: sitemapNamespace, URLs: make([]sitemapLoc, len(chunk))}
+		for i, p := range chunk {
+			set.URLs[i].Loc = resolve(p)
+		}
+		return set
+	}
+
+	if len(chunks) == 1 {
+		return written, write("sitemap.xml", urlSet(chunks[0]))
+	}
+
+	index := sitemapIndex{XMLNS: sitemapNamespace}
+	for i, chunk := range chunks {
+		file := fmt.Sprintf("sitemap-%d.xml", i+1)
+		if err := write(file, urlSet(chunk)); err != nil {
+			return written, err
+		}
+		index.Sitemaps = append(index.Sitemaps, sitemapLoc{Loc: resolve(file)})
+	}
+	return written, write("sitemap.xml", index)
+}
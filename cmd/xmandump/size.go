@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag.Value for a size in bytes. It accepts an integer with an optional K, M, G, or T
+// suffix (powers of 1024), optionally followed by B or iB.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+func parseByteSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	str = strings.TrimSuffix(str, "I")
+
+	shift := uint(0)
+	if len(str) > 0 {
+		switch str[len(str)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift != 0 {
+			str = str[:len(str)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	if n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("size too large: %q", s)
+	}
+	return n << shift, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// manpageSizeDivisor is the fraction of a package's installed size assumed to be manpages when
+// estimating the space a run needs. Manpages rarely make up more than 1% of a package.
+const manpageSizeDivisor = 100
+
+// checkSpace returns an error if extracting the packages of repos would leave less than MinFree
+// bytes free in the output directory. It is called as each set of repodata files is loaded, so
+// the space used by earlier ones is already accounted for. It does nothing if MinFree is not
+// positive.
+func (d *Dumper) checkSpace(ctx context.Context, repos []*queuedRepo) error {
+	if d.MinFree <= 0 {
+		return nil
+	}
+	need := d.estimateSpace(repos)
+	free, err := freeSpace(".")
+	if err != nil {
+		return fmt.Errorf("unable to get free space of output directory: %v", err)
+	}
+	Debug(ctx, "Estimated space needed", zap.Int64("needed", need), zap.Int64("free", free))
+	if free-need < d.MinFree {
+		return fmt.Errorf("not enough free space in output directory: need %d bytes, %d free, %d must remain free", need, free, d.MinFree)
+	}
+	return nil
+}
+
+// estimateSpace estimates the bytes needed to extract the packages of repos, from their installed
+// sizes. Packages that a run would skip or take from the cache are not counted.
+func (d *Dumper) estimateSpace(repos []*queuedRepo) int64 {
+	var total int64
+	for _, repo := range repos {
+		for _, pkg := range repo.pkgs {
+			if matchSuffix(d.SkipSuffixes, pkg.Name) != "" || !d.Filter.match(pkg.Name) {
+				continue
+			} else if !d.Since.IsZero() && pkg.BuildDate.Time().Before(d.Since) {
+				continue
+			}
+			key := d.cacheKey(pkg)
+			_, repair := d.Repair[key]
+			if _, ok := d.Cache[key]; ok && !repair && !matchAny(d.Force, pkg.Name) {
+				continue
+			}
+			total += pkg.InstalledSize / manpageSizeDivisor
+		}
+	}
+	return total
+}
+
+// freeSpace returns the bytes available to unprivileged users on the filesystem containing dir.
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
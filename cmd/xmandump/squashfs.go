@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const squashfsTempSuffix = ".xmandump-squashfs"
+
+// buildSquashfs builds a squashfs image of files in the output tree in the current directory at
+// image using mksquashfs (tool). Anything else in the output directory, such as a cache file or the
+// image itself if it's placed there, is left out of the image. The image is built under a
+// temporary name and renamed into place, so readers of image never see a partial image. If
+// reproducible is true, the image's creation time is fixed.
+func buildSquashfs(ctx context.Context, tool, image string, files []string, reproducible bool) error {
+	ctx = WithFields(ctx, zap.String("squashfs", image))
+
+	timer := Elapsed("elapsed")
+	Info(ctx, "Building squashfs image")
+	defer func() { Info(ctx, "Finished building squashfs image", timer()) }()
+
+	// The image and its temporary file are excluded in case they're placed within the output tree.
+	tmp := image + squashfsTempSuffix
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	var exclude []string
+	excluded := map[string]struct{}{}
+	for _, file := range []string{image, tmp} {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(wd, abs); err == nil && isRelativeTreePath(rel) {
+			exclude = append(exclude, rel)
+			excluded[rel] = struct{}{}
+		}
+	}
+
+	// mksquashfs can't be given a list of files, so exclude top-level entries that aren't part of
+	// the tree instead.
+	top := map[string]struct{}{}
+	for _, file := range files {
+		top[strings.SplitN(filepath.ToSlash(file), "/", 2)[0]] = struct{}{}
+	}
+	entries, err := ioutil.ReadDir(".")
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		_, ok := top[fi.Name()]
+		if _, skip := excluded[fi.Name()]; !ok && !skip {
+			exclude = append(exclude, fi.Name())
+		}
+	}
+
+	args := []string{".", tmp, "-noappend", "-no-progress"}
+	if reproducible {
+		args = append(args, "-mkfs-time", "0")
+	}
+	if len(exclude) > 0 {
+		ef, err := ioutil.TempFile("", "xmandump-squashfs-exclude")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(ef.Name())
+		_, err = ef.WriteString(strings.Join(exclude, "\n") + "\n")
+		if cerr := ef.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		args = append(args, "-ef", ef.Name())
+	}
+
+	cmd := exec.Command(tool, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	Debug(ctx, "Running mksquashfs", zap.Strings("args", args))
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, image); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
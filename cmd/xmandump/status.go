@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxStatusErrors = 100
+
+// runStatus tracks the progress of a run. It is safe for concurrent use, and all methods may be
+// called on a nil *runStatus, in which case they do nothing.
+type runStatus struct {
+	started   time.Time
+	bytesRead int64 // atomic
+	written   int64 // atomic
+	progress  int64 // atomic; UnixNano of the last package processed or page written
+
+	m      sync.Mutex
+	repos  map[string]*repoStatus
+	order  []string
+	errors []statusError
+}
+
+// repoStatus is the progress of a single repodata file.
+type repoStatus struct {
+	Name     string `json:"name"`
+	Packages int    `json:"packages"`
+	Done     int    `json:"done"`
+	Errors   int    `json:"errors"`
+	Finished bool   `json:"finished"`
+}
+
+// statusError is an error encountered while processing a package.
+type statusError struct {
+	Time    time.Time `json:"time"`
+	File    string    `json:"file"`
+	Message string    `json:"error"`
+}
+
+// statusSnapshot is a point-in-time copy of a runStatus.
+type statusSnapshot struct {
+	Started      time.Time     `json:"started"`
+	Elapsed      time.Duration `json:"elapsed"`
+	LastProgress time.Time     `json:"last_progress"`
+	BytesRead    int64         `json:"bytes_read"`
+	PagesWritten int64         `json:"pages_written"`
+	Packages     int           `json:"packages"`
+	Done         int           `json:"done"`
+	Queued       int           `json:"queued"` // Packages not yet processed
+	Repos        []repoStatus  `json:"repos"`
+	Errors       []statusError `json:"errors"`
+	LastError    *statusError  `json:"last_error,omitempty"`
+}
+
+func newRunStatus() *runStatus {
+	now := time.Now()
+	return &runStatus{
+		started:  now,
+		progress: now.UnixNano(),
+		repos:    map[string]*repoStatus{},
+	}
+}
+
+func (s *runStatus) repo(name string) *repoStatus {
+	rs, ok := s.repos[name]
+	if !ok {
+		rs = &repoStatus{Name: name}
+		s.repos[name] = rs
+		s.order = append(s.order, name)
+	}
+	return rs
+}
+
+// addRepo records the number of packages in a repodata file.
+func (s *runStatus) addRepo(name string, packages int) {
+	if s == nil {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	rs := s.repo(name)
+	rs.Packages += packages
+	rs.Finished = rs.Done >= rs.Packages
+}
+
+// packageDone records that a package from the named repodata file has been processed.
+func (s *runStatus) packageDone(name, file string, err error) {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(&s.progress, time.Now().UnixNano())
+	s.m.Lock()
+	defer s.m.Unlock()
+	rs := s.repo(name)
+	rs.Done++
+	rs.Finished = rs.Done >= rs.Packages
+	if err == nil {
+		return
+	}
+	rs.Errors++
+	s.errors = append(s.errors, statusError{Time: time.Now(), File: file, Message: err.Error()})
+	if len(s.errors) > maxStatusErrors {
+		s.errors = s.errors[len(s.errors)-maxStatusErrors:]
+	}
+}
+
+// pageWritten records that a manpage was written.
+func (s *runStatus) pageWritten() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.written, 1)
+	atomic.StoreInt64(&s.progress, time.Now().UnixNano())
+}
+
+// countReader returns r wrapped such that all bytes read from it are added to the bytes read.
+func (s *runStatus) countReader(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &s.bytesRead}
+}
+
+// snapshot returns a copy of the current status.
+func (s *runStatus) snapshot() statusSnapshot {
+	if s == nil {
+		return statusSnapshot{}
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	snap := statusSnapshot{
+		Started:      s.started,
+		Elapsed:      time.Since(s.started),
+		LastProgress: time.Unix(0, atomic.LoadInt64(&s.progress)),
+		BytesRead:    atomic.LoadInt64(&s.bytesRead),
+		PagesWritten: atomic.LoadInt64(&s.written),
+		Repos:        make([]repoStatus, 0, len(s.order)),
+		Errors:       append([]statusError(nil), s.errors...),
+	}
+	for _, name := range s.order {
+		rs := *s.repos[name]
+		snap.Packages += rs.Packages
+		snap.Done += rs.Done
+		snap.Repos = append(snap.Repos, rs)
+	}
+	snap.Queued = snap.Packages - snap.Done
+	if len(snap.Errors) > 0 {
+		snap.LastError = &snap.Errors[len(snap.Errors)-1]
+	}
+	return snap
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// statusStallTimeout is how long a run may go without processing a package or writing a page
+// before /healthz reports it as unhealthy.
+const statusStallTimeout = 10 * time.Minute
+
+// startStatusServer serves the status of a run over HTTP at addr for monitoring:
+//
+//	/healthz responds 200 while the run is making progress and 503 once it has stalled.
+//	/status responds with the status of the run as JSON.
+func startStatusServer(ctx context.Context, addr string, status *runStatus) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		snap := status.snapshot()
+		if stalled := time.Since(snap.LastProgress); stalled > statusStallTimeout {
+			http.Error(w, fmt.Sprintf("no progress for %v", stalled.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status.snapshot())
+	})
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			Error(ctx, "Status server failed", zap.Error(err))
+		}
+	}()
+	Info(ctx, "Serving status", zap.String("addr", ln.Addr().String()))
+	return srv, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// runSyncCommand runs command with sh -c in the output directory to upload the output tree
+// (e.g., with rsync or rclone). The paths of the rsync lists written for this run, if any, are
+// passed in the environment as XMANDUMP_RSYNC_FILES_FROM and XMANDUMP_RSYNC_FILTER.
+func runSyncCommand(ctx context.Context, command, filesFrom, filter string) error {
+	ctx = WithFields(ctx, zap.String("command", command))
+
+	timer := Elapsed("elapsed")
+	Info(ctx, "Running sync command")
+	defer func() { Info(ctx, "Finished running sync command", timer()) }()
+
+	env := os.Environ()
+	for name, file := range map[string]string{
+		"XMANDUMP_RSYNC_FILES_FROM": filesFrom,
+		"XMANDUMP_RSYNC_FILTER":     filter,
+	} {
+		if file == "" {
+			continue
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		env = append(env, name+"="+abs)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = env
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
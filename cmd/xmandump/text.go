@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// textSuffix is the suffix of plain-text renditions of manpages.
+const textSuffix = ".txt"
+
+// textPath returns the path of the plain-text rendition of the manpage at relpath.
+func textPath(relpath string) string {
+	return trimPageCompression(relpath) + textSuffix
+}
+
+// renderText writes a plain-text rendition of the manpage at relpath using mandoc. Links to
+// manpages are rendered as links to the target's rendition. It returns the path written, or an
+// empty string if nothing was written.
+func (d *Dumper) renderText(ctx context.Context, typeflag byte, relpath, lname string) (string, error) {
+	txt := textPath(relpath)
+	ctx = WithFields(ctx, zap.String("text_file", txt))
+
+	if err := removeExisting(txt); err != nil {
+		Error(ctx, "Unable to remove existing text file", zap.Error(err))
+		return "", err
+	}
+
+	switch typeflag {
+	case tar.TypeSymlink:
+		if err := os.Symlink(textPath(lname), txt); err != nil {
+			Error(ctx, "Unable to create text symlink", zap.Error(err))
+			return "", err
+		}
+		return txt, nil
+	case tar.TypeLink:
+		err := os.Link(textPath(lname), txt)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			Error(ctx, "Unable to create text hard link", zap.Error(err))
+			return "", err
+		}
+		return txt, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(d.Mandoc, "-Tutf8", relpath)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			Error(ctx, "Unable to run mandoc", zap.Error(err))
+			return "", err
+		}
+		// mandoc exits non-zero for pages with errors but still renders what it can.
+		Warn(ctx, "mandoc reported errors rendering manpage", zap.Error(err), zap.ByteString("stderr", stderr.Bytes()))
+	}
+
+	f, err := createNoFollow(txt, 0666)
+	if err != nil {
+		Error(ctx, "Unable to create text file", zap.Error(err))
+		return "", err
+	}
+	defer logClose(ctx, f)
+	if _, err := f.Write(stripOverstrike(stdout.Bytes())); err != nil {
+		Error(ctx, "Error writing text file", zap.Error(err))
+		return txt, err
+	}
+	return txt, nil
+}
+
+// stripOverstrike removes the backspace sequences used by terminal output for bold and underlined
+// text, leaving only the last character of each sequence.
+func stripOverstrike(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c != '\b' {
+			out = append(out, c)
+			continue
+		}
+		_, size := utf8.DecodeLastRune(out)
+		out = out[:len(out)-size]
+	}
+	return out
+}
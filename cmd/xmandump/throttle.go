@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// writeLimiter limits the combined rate of writes through its writers to a number of bytes per
+// second, so that extraction doesn't starve other users of the disk.
+type writeLimiter struct {
+	rate int64 // Bytes per second
+
+	m    sync.Mutex
+	next time.Time // When the next write may start
+}
+
+// newWriteLimiter returns a limiter of rate bytes per second, or nil if rate is not positive.
+func newWriteLimiter(rate int64) *writeLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &writeLimiter{rate: rate}
+}
+
+// writer returns w wrapped such that writes are limited by l.
+func (l *writeLimiter) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{w: w, l: l}
+}
+
+// wait reserves n bytes and sleeps until they may be written.
+func (l *writeLimiter) wait(n int) {
+	l.m.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.m.Unlock()
+	time.Sleep(delay)
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *writeLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (written int, err error) {
+	// Write at most a second's worth at a time so that concurrent writers are interleaved.
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > lw.l.rate {
+			chunk = chunk[:lw.l.rate]
+		}
+		lw.l.wait(len(chunk))
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
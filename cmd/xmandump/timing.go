@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// packageTiming is the time taken to extract a package.
+type packageTiming struct {
+	Package string
+	Elapsed time.Duration
+}
+
+func (t packageTiming) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("package", t.Package)
+	enc.AddDuration("elapsed", t.Elapsed)
+	return nil
+}
+
+// packageTimingList is a list of package timings that can be logged as an array.
+type packageTimingList []packageTiming
+
+func (l packageTimingList) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, t := range l {
+		if err := enc.AppendObject(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packageTimings collects the time taken to extract each package, so that unusually slow packages
+// can be reported at the end of a run. Packages that are cached or skipped aren't recorded.
+type packageTimings struct {
+	m       sync.Mutex
+	timings packageTimingList
+}
+
+// record records that pkgver took elapsed to extract. It does nothing if t is nil.
+func (t *packageTimings) record(pkgver string, elapsed time.Duration) {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.timings = append(t.timings, packageTiming{Package: pkgver, Elapsed: elapsed})
+}
+
+// fields returns log fields summarizing the recorded timings: the number of packages, the 50th,
+// 95th, and 99th percentiles, and the slowest n packages. It returns nil if nothing was recorded.
+func (t *packageTimings) fields(n int) []zap.Field {
+	if t == nil {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if len(t.timings) == 0 {
+		return nil
+	}
+	sort.Slice(t.timings, func(i, j int) bool { return t.timings[i].Elapsed > t.timings[j].Elapsed })
+
+	// Nearest-rank percentile of timings sorted from slowest to fastest
+	percentile := func(p int) time.Duration {
+		rank := (p*len(t.timings) + 99) / 100
+		return t.timings[len(t.timings)-rank].Elapsed
+	}
+
+	if n > len(t.timings) {
+		n = len(t.timings)
+	} else if n < 0 {
+		n = 0
+	}
+	return []zap.Field{
+		zap.Int("packages", len(t.timings)),
+		zap.Duration("p50", percentile(50)),
+		zap.Duration("p95", percentile(95)),
+		zap.Duration("p99", percentile(99)),
+		zap.Array("slowest", t.timings[:n]),
+	}
+}
+
+// Phases of a run reported by phaseTimings.
+const (
+	phaseRepodata   = "repodata"   // Reading repodata files
+	phaseCache      = "cache"      // Reusing the cached manpages of unchanged packages
+	phaseDecompress = "decompress" // Decompressing package archives
+	phasePlist      = "plist"      // Decoding files lists
+	phaseWrite      = "write"      // Writing manpages
+	phaseCleanup    = "cleanup"    // Removing old files
+)
+
+var phaseOrder = []string{phaseRepodata, phaseCache, phaseDecompress, phasePlist, phaseWrite, phaseCleanup}
+
+// phaseTimings collects the time spent in each phase of a run. Phases run by concurrent workers
+// are summed across them, so they may add up to more than the run's elapsed time.
+type phaseTimings struct {
+	m       sync.Mutex
+	elapsed map[string]time.Duration
+}
+
+// add adds elapsed to the time spent in phase. It does nothing if t is nil.
+func (t *phaseTimings) add(phase string, elapsed time.Duration) {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.elapsed == nil {
+		t.elapsed = map[string]time.Duration{}
+	}
+	t.elapsed[phase] += elapsed
+}
+
+// fields returns log fields with the time spent in each phase, or nil if t is nil.
+func (t *phaseTimings) fields() []zap.Field {
+	if t == nil {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	fields := make([]zap.Field, 0, len(phaseOrder))
+	for _, phase := range phaseOrder {
+		fields = append(fields, zap.Duration(phase, t.elapsed[phase]))
+	}
+	return fields
+}
+
+// timedReader adds the time spent reading from r to elapsed.
+type timedReader struct {
+	r       io.Reader
+	elapsed *time.Duration
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.r.Read(p)
+	*r.elapsed += time.Since(start)
+	return n, err
+}
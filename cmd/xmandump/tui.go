@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	tuiInterval  = 250 * time.Millisecond
+	tuiBarWidth  = 30
+	tuiErrorRows = 10
+)
+
+// tui draws live progress of a run to a terminal.
+type tui struct {
+	w      io.Writer
+	status *runStatus
+	lines  int
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// startTUI starts drawing status to w until Stop is called.
+func startTUI(w io.Writer, status *runStatus) *tui {
+	t := &tui{
+		w:      w,
+		status: status,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tui) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(tuiInterval)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			t.draw()
+			return
+		}
+	}
+}
+
+// Stop draws the final status and stops the TUI.
+func (t *tui) Stop() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *tui) draw() {
+	snap := t.status.snapshot()
+	var buf bytes.Buffer
+
+	// Move back to the start of the previous frame and clear it.
+	if t.lines > 0 {
+		fmt.Fprintf(&buf, "\x1b[%dA", t.lines)
+	}
+	buf.WriteString("\r\x1b[J")
+
+	secs := snap.Elapsed.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	fmt.Fprintf(&buf, "xmandump  %s  %d/%d packages (%.1f/s)  %s read (%s/s)  %d pages written\n",
+		snap.Elapsed.Round(time.Second),
+		snap.Done, snap.Packages, float64(snap.Done)/secs,
+		formatBytes(float64(snap.BytesRead)), formatBytes(float64(snap.BytesRead)/secs),
+		snap.PagesWritten,
+	)
+
+	for _, rs := range snap.Repos {
+		filled := 0
+		if rs.Packages > 0 {
+			filled = tuiBarWidth * rs.Done / rs.Packages
+		}
+		if rs.Finished {
+			filled = tuiBarWidth
+		}
+		fmt.Fprintf(&buf, "%-24s [%s%s] %d/%d", filepath.Base(rs.Name),
+			strings.Repeat("#", filled), strings.Repeat(".", tuiBarWidth-filled),
+			rs.Done, rs.Packages)
+		if rs.Errors > 0 {
+			fmt.Fprintf(&buf, "  %d errors", rs.Errors)
+		}
+		buf.WriteByte('\n')
+	}
+
+	errs := snap.Errors
+	if len(errs) > tuiErrorRows {
+		errs = errs[len(errs)-tuiErrorRows:]
+	}
+	if len(errs) > 0 {
+		buf.WriteString("Errors:\n")
+	}
+	for _, e := range errs {
+		fmt.Fprintf(&buf, "  %s: %s\n", filepath.Base(e.File), e.Message)
+	}
+
+	t.lines = bytes.Count(buf.Bytes(), []byte{'\n'})
+	_, _ = t.w.Write(buf.Bytes())
+}
+
+// formatBytes formats n as a human-readable byte count.
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	suffixes := "KMGTPE"
+	i := -1
+	for n >= unit && i < len(suffixes)-1 {
+		n /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, suffixes[i])
+}
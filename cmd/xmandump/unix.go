@@ -1,7 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -16,3 +22,125 @@ func getFileLimit() (limit int64, err error) {
 	}
 	return int64(rlim.Cur), nil
 }
+
+// createNoFollow creates or truncates the file at path for writing. Unlike os.Create, it refuses to
+// open path if it is a symlink, so that a symlink left in place of a regular file cannot be used to
+// write outside of the output directory.
+func createNoFollow(path string, mode os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_NOFOLLOW, mode)
+}
+
+// dropPrivileges switches the process to the given user and group, each of which may be a name or
+// numeric ID. If group is empty, the user's primary group is used. If user is empty, only the group
+// is changed. Supplementary groups are cleared.
+func dropPrivileges(username, groupname string) error {
+	uid, gid, err := lookupIDs(username, groupname)
+	if err != nil {
+		return err
+	}
+
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %v", err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %v", err)
+		}
+	}
+	return nil
+}
+
+// lookupIDs returns the uid and gid of the given user and group, each of which may be a name or
+// numeric ID. If group is empty, the user's primary group is used. Either is -1 if not set.
+func lookupIDs(username, groupname string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if username != "" {
+		u, err := lookupUser(username)
+		if err != nil {
+			return -1, -1, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return -1, -1, fmt.Errorf("invalid uid for user %s: %v", username, err)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return -1, -1, fmt.Errorf("invalid gid for user %s: %v", username, err)
+		}
+	}
+
+	if groupname != "" {
+		g, err := lookupGroup(groupname)
+		if err != nil {
+			return -1, -1, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return -1, -1, fmt.Errorf("invalid gid for group %s: %v", groupname, err)
+		}
+	}
+	return uid, gid, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		if _, perr := strconv.Atoi(name); perr == nil {
+			return user.LookupId(name)
+		}
+	}
+	return u, err
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if _, ok := err.(user.UnknownGroupError); ok {
+		if _, perr := strconv.Atoi(name); perr == nil {
+			return user.LookupGroupId(name)
+		}
+	}
+	return g, err
+}
+
+// mmapFile maps the whole of f into memory for reading. The returned function unmaps it.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := fi.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil, fmt.Errorf("cannot map file of size %d", size)
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, func() error { return unix.Munmap(data) }, nil
+}
+
+// linkCount returns the number of hard links to the file described by fi, or 1 if it is unknown.
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// fileIDs returns the owner and group IDs of fi, or -1 if they're unknown.
+func fileIDs(fi os.FileInfo) (uid, gid int) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return -1, -1
+}
+
+// lchtimes sets the access and modification times of path to t without following symlinks.
+func lchtimes(path string, t time.Time) error {
+	ts := unix.NsecToTimespec(t.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
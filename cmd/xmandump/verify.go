@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+func init() {
+	subcommands["verify"] = &subcommand{
+		Usage: "verify [-C dir] [-j N] -c cache -- check the output tree against the files recorded in the cache",
+		Run:   runVerify,
+	}
+}
+
+// Problems reported by the verify subcommand.
+const (
+	problemMissing  = "missing"  // The file does not exist
+	problemDangling = "dangling" // The file is a symlink whose target does not exist
+	problemCorrupt  = "corrupt"  // The file is a compressed manpage that cannot be decompressed
+)
+
+// verifyProblem describes a file recorded in the cache that is missing or damaged.
+type verifyProblem struct {
+	Path    string   `json:"path"`
+	Keys    []string `json:"keys"` // Cache keys of the packages the file came from, sorted
+	Problem string   `json:"problem"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func runVerify(args []string) int {
+	var (
+		flagLevel = zap.WarnLevel
+		dir       = "."
+		cacheFile string
+		jobs      int64 = 4
+	)
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Var(&flagLevel, "v", "log level")
+	fs.StringVar(&dir, "C", dir, "output directory")
+	fs.StringVar(&cacheFile, "c", "", "cache file")
+	fs.Int64Var(&jobs, "j", jobs, "number of files to check concurrently")
+	_ = fs.Parse(args)
+
+	if cacheFile == "" {
+		return fatalf("no cache file given (-c)")
+	} else if jobs < 1 {
+		return fatalf("invalid -j: must be >= 1")
+	}
+
+	logger, err := NewLogger(zap.NewAtomicLevelAt(flagLevel))
+	if err != nil {
+		return fatalf("unable to create logger: %v", err)
+	}
+	ctx := WithLogger(context.Background(), logger)
+
+	cache, err := readCacheFile(cacheFile)
+	if err != nil {
+		return fatalf("unable to read cache: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fatalf("unable to change to output directory: %v", err)
+	}
+
+	problems := verifyTree(ctx, cache.Cache, jobs)
+	enc := json.NewEncoder(os.Stdout)
+	for _, problem := range problems {
+		_ = enc.Encode(problem)
+	}
+	if len(problems) > 0 {
+		logger.Warn("Problems found in output tree", zap.Int("files", len(problems)))
+		return 1
+	}
+	return 0
+}
+
+// readCacheFile reads the cache records in file.
+func readCacheFile(file string) (cache cacheRecords, err error) {
+	p, err := ioutil.ReadFile(file)
+	if err != nil {
+		return cache, err
+	}
+	err = json.Unmarshal(p, &cache)
+	return cache, err
+}
+
+// verifyTree checks each file recorded in cache, relative to the current directory, checking up to
+// jobs files concurrently. It returns the problems found, sorted by path. A file recorded for more
+// than one package is checked once and reported against all of them.
+func verifyTree(ctx context.Context, cache map[string][]string, jobs int64) []verifyProblem {
+	var (
+		m        sync.Mutex
+		problems []verifyProblem
+		owners   = map[string][]string{}
+	)
+	for key, paths := range cache {
+		for _, p := range paths {
+			owners[p] = append(owners[p], key)
+		}
+	}
+	paths := make([]string, 0, len(owners))
+	for p := range owners {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	sema := semaphore.NewWeighted(jobs)
+	wg, ctx := errgroup.WithContext(ctx)
+	for _, p := range paths {
+		p := p
+		if !isRelativeTreePath(p) {
+			Debug(ctx, "Skipping unsafe file path", logFile(p))
+			continue
+		}
+		if err := sema.Acquire(ctx, 1); err != nil {
+			break
+		}
+		wg.Go(func() error {
+			defer sema.Release(1)
+			problem, err := verifyFile(ctx, p)
+			if problem == "" {
+				return nil
+			}
+			Debug(ctx, "Problem found in output tree", logFile(p), zap.String("problem", problem), zap.Error(err))
+			keys := append([]string(nil), owners[p]...)
+			sort.Strings(keys)
+			vp := verifyProblem{Path: p, Keys: keys, Problem: problem}
+			if err != nil {
+				vp.Error = err.Error()
+			}
+			m.Lock()
+			defer m.Unlock()
+			problems = append(problems, vp)
+			return nil
+		})
+	}
+	_ = wg.Wait()
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	return problems
+}
+
+// verifyFile checks the file at relpath, returning the problem found, if any, and the error that
+// revealed it. Compressed manpages are decompressed in full to check their integrity.
+func verifyFile(ctx context.Context, relpath string) (problem string, err error) {
+	fi, err := os.Lstat(relpath)
+	if os.IsNotExist(err) {
+		return problemMissing, nil
+	} else if err != nil {
+		return problemMissing, err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if _, err := os.Stat(relpath); err != nil {
+			return problemDangling, err
+		}
+		return "", nil
+	} else if !fi.Mode().IsRegular() || pageCompression(relpath) == "" {
+		return "", nil
+	}
+
+	f, err := os.Open(relpath)
+	if err != nil {
+		return problemCorrupt, err
+	}
+	defer logClose(ctx, f)
+	r, err := newPageDecompressor(pageCompression(relpath), f)
+	if err != nil {
+		return problemCorrupt, err
+	}
+	defer logClose(ctx, r)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return problemCorrupt, err
+	}
+	return "", nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"go.uber.org/zap"
+)
+
+// Supported tools for building apropos databases.
+const (
+	whatisMakewhatis = "makewhatis"
+	whatisMandb      = "mandb"
+)
+
+// validWhatisTool returns whether tool is a supported apropos database tool.
+func validWhatisTool(tool string) bool {
+	return tool == whatisMakewhatis || tool == whatisMandb
+}
+
+// buildWhatis builds an apropos database (mandoc's mandoc.db or man-db's index.db) over the output
+// tree in the current directory using the given tool. It returns the path of the database relative
+// to the output tree.
+func buildWhatis(ctx context.Context, tool string) (string, error) {
+	var (
+		db  string
+		cmd *exec.Cmd
+	)
+	switch tool {
+	case whatisMakewhatis:
+		db = "mandoc.db"
+		cmd = exec.Command(tool, ".")
+	case whatisMandb:
+		// man-db places the database for hierarchies that aren't in its configuration at the top
+		// of the hierarchy, which must be given as an absolute path.
+		root, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		db = "index.db"
+		cmd = exec.Command(tool, "--quiet", "--create", root)
+	default:
+		return "", fmt.Errorf("unsupported apropos database tool: %s", tool)
+	}
+
+	Debug(ctx, "Building apropos database", zap.String("tool", tool), logDumpFile(db))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return db, cmd.Run()
+}
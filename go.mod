@@ -1,8 +1,9 @@
 module github.com/void-linux/xmandump
 
-go 1.12
+go 1.19
 
 require (
+	github.com/andybalholm/brotli v1.0.0
 	github.com/gabriel-vasile/mimetype v1.1.0
 	github.com/klauspost/compress v1.10.6
 	github.com/ulikunitz/xz v0.5.7
@@ -12,3 +13,8 @@ require (
 	golang.org/x/tools v0.0.0-20200522201501-cb1345f3a375
 	howett.net/plist v0.0.0-20200419221736-3b63eb3a43b5
 )
+
+require (
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+)